@@ -4,6 +4,8 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -26,6 +28,7 @@ type Client struct {
 	sync.Mutex
 
 	net, addr    string
+	tlsConfig    *tls.Config //nil for plain TCP
 	respHandler  *responseHandlerMap
 	innerHandler *responseHandlerMap
 	in           chan *Response
@@ -33,6 +36,7 @@ type Client struct {
 	rw           *bufio.ReadWriter
 
 	ResponseTimeout time.Duration // response timeout for do()
+	MaxPacketSize   int           // largest packet data accepted, rt.DefaultMaxPacketSize when 0
 
 	ErrorHandler ErrorHandler
 }
@@ -71,15 +75,27 @@ func (r *responseHandlerMap) put(key string, rh ResponseHandler) {
 //
 // Returns a new Client instance or an error if connection fails.
 func New(network, addr string) (client *Client, err error) {
+	return NewTLS(network, addr, nil)
+}
+
+// NewTLS creates a new Gearman client connection over TLS.
+// Parameters:
+//   - network: The network type (typically "tcp")
+//   - addr: The server address (e.g., "127.0.0.1:4730")
+//   - config: The TLS configuration, plain TCP when nil
+//
+// Returns a new Client instance or an error if connection fails.
+func NewTLS(network, addr string, config *tls.Config) (client *Client, err error) {
 	client = &Client{
 		net:             network,
 		addr:            addr,
 		respHandler:     newResponseHandlerMap(),
 		innerHandler:    newResponseHandlerMap(),
 		in:              make(chan *Response, rt.QueueSize),
+		tlsConfig:       config,
 		ResponseTimeout: DefaultTimeout,
 	}
-	client.conn, err = net.Dial(client.net, client.addr)
+	client.conn, err = client.dial()
 	if err != nil {
 		return
 	}
@@ -90,6 +106,14 @@ func New(network, addr string) (client *Client, err error) {
 	return
 }
 
+// dial connects to the server, with TLS if configured.
+func (client *Client) dial() (net.Conn, error) {
+	if client.tlsConfig != nil {
+		return tls.Dial(client.net, client.addr, client.tlsConfig)
+	}
+	return net.Dial(client.net, client.addr)
+}
+
 func (client *Client) write(req *request) (err error) {
 	var n int
 	buf := req.Encode()
@@ -140,7 +164,7 @@ ReadLoop:
 			// closed by Gearmand, the client should close the conection
 			// and reconnect to job server.
 			client.Close()
-			client.conn, err = net.Dial(client.net, client.addr)
+			client.conn, err = client.dial()
 			if err != nil {
 				client.err(err)
 				break
@@ -159,6 +183,12 @@ ReadLoop:
 				leftdata = data
 				continue ReadLoop
 			}
+			if size := binary.BigEndian.Uint32(data[8:12]); int64(size) > int64(client.maxPacketSize()) {
+				// don't buffer it, the connection can't be trusted anymore
+				client.err(ErrPacketTooLarge)
+				client.Close()
+				break ReadLoop
+			}
 			if resp, l, err = decodeResponse(data); err != nil {
 				leftdata = data[l:]
 				continue ReadLoop
@@ -174,18 +204,36 @@ ReadLoop:
 	}
 }
 
+func (client *Client) maxPacketSize() int {
+	if client.MaxPacketSize > 0 {
+		return client.MaxPacketSize
+	}
+	return rt.DefaultMaxPacketSize
+}
+
 func (client *Client) processLoop() {
 	for resp := range client.in {
 		switch resp.DataType {
 		case rt.PT_Error:
-			log.Errorln("Received error", resp.Data)
-			client.err(getError(resp.Data))
+			//a submission is answered with either JOB_CREATED or ERROR,
+			//an option request with either OPTION_RES or ERROR
+			if resp = client.handleInner("o", resp); resp != nil {
+				resp = client.handleInner("c", resp)
+			}
+			if resp != nil {
+				log.Errorln("Received error", resp.Data)
+				client.err(getError(resp.Data))
+			}
 		case rt.PT_StatusRes:
 			resp = client.handleInner("s"+resp.Handle, resp)
+		case rt.PT_StatusResUnique:
+			resp = client.handleInner("u"+resp.Handle, resp)
 		case rt.PT_JobCreated:
 			resp = client.handleInner("c", resp)
 		case rt.PT_EchoRes:
 			resp = client.handleInner("e", resp)
+		case rt.PT_OptionRes:
+			resp = client.handleInner("o", resp)
 		case rt.PT_WorkData, rt.PT_WorkWarning, rt.PT_WorkStatus:
 			resp = client.handleResponse(resp.Handle, resp)
 		case rt.PT_WorkComplete, rt.PT_WorkFail, rt.PT_WorkException:
@@ -232,12 +280,10 @@ func (client *Client) do(funcname string, data []byte, flag rt.PT) (handle strin
 	defer client.Unlock()
 	client.innerHandler.put("c", func(resp *Response) {
 		if resp.DataType == rt.PT_Error {
-			err = getError(resp.Data)
-			result <- handleOrError{"", err}
+			result <- handleOrError{"", getError(resp.Data)}
 			return
 		}
-		handle = resp.Handle
-		result <- handleOrError{handle, nil}
+		result <- handleOrError{resp.Handle, nil}
 	})
 	id := IdGen.Id()
 	req := getJob(id, []byte(funcname), data)
@@ -304,6 +350,43 @@ func (client *Client) DoBg(funcname string, data []byte, flag byte) (handle stri
 	return
 }
 
+// DoReduce calls the function with a reducer and gets a response.
+// Workers grabbing jobs with GRAB_JOB_ALL receive the reducer name.
+// Parameters:
+//   - funcname: The name of the function to call
+//   - reducer: The name of the reducer function
+//   - data: The data to pass to the function
+//   - h: Response handler to process the result
+//
+// Returns the job handle and an error if the operation fails.
+func (client *Client) DoReduce(funcname, reducer string, data []byte,
+	h ResponseHandler) (handle string, err error) {
+	handle, err = client.do(funcname, reduceData(reducer, data), rt.PT_SubmitReduceJob)
+	if err == nil && h != nil {
+		client.respHandler.put(handle, h)
+	}
+	return
+}
+
+// DoReduceBg calls the function with a reducer in background, no response needed.
+// Parameters:
+//   - funcname: The name of the function to call
+//   - reducer: The name of the reducer function
+//   - data: The data to pass to the function
+//
+// Returns the job handle and an error if the operation fails.
+func (client *Client) DoReduceBg(funcname, reducer string, data []byte) (handle string, err error) {
+	return client.do(funcname, reduceData(reducer, data), rt.PT_SubmitReduceJobBackground)
+}
+
+// reduceData prefixes the workload with the reducer and an empty aggregator.
+func reduceData(reducer string, data []byte) []byte {
+	buf := make([]byte, 0, len(reducer)+len(data)+2)
+	buf = append(buf, reducer...)
+	buf = append(buf, '\x00', '\x00')
+	return append(buf, data...)
+}
+
 // DoCron schedules a function to run on a cron schedule.
 // Parameters:
 //   - funcname: The name of the function to call
@@ -386,6 +469,34 @@ func (client *Client) Status(handle string) (status *Status, err error) {
 	return
 }
 
+// StatusUnique gets the status of a job by its unique id from job server.
+// The returned status also reports how many clients are waiting for the job.
+// Parameters:
+//   - unique: The unique id the job was submitted with
+//
+// Returns the job status and an error if the operation fails.
+func (client *Client) StatusUnique(unique string) (status *Status, err error) {
+	if client.conn == nil {
+		return nil, ErrLostConn
+	}
+	var mutex sync.Mutex
+	mutex.Lock()
+	client.innerHandler.put("u"+unique, func(resp *Response) {
+		defer mutex.Unlock()
+		var err error
+		status, err = resp._statusUnique()
+		if err != nil {
+			client.err(err)
+		}
+	})
+	req := getRequest()
+	req.DataType = rt.PT_GetStatusUnique
+	req.Data = []byte(unique)
+	client.write(req)
+	mutex.Lock()
+	return
+}
+
 // Echo sends data to the server and receives it back.
 // This is useful for testing connectivity and server responsiveness.
 //
@@ -411,6 +522,42 @@ func (client *Client) Echo(data []byte) (echo []byte, err error) {
 	return
 }
 
+// SetOption turns on an option of the connection on the server, e.g.
+// "exceptions" to receive WORK_EXCEPTION packets of the jobs. Without it
+// the server reports failed jobs with WORK_FAIL only.
+//
+// Returns an *Error matching ErrInvalidOption if the server doesn't know
+// the option.
+func (client *Client) SetOption(option string) (err error) {
+	if client.conn == nil {
+		return ErrLostConn
+	}
+	var result = make(chan error, 1)
+	client.Lock()
+	defer client.Unlock()
+	client.innerHandler.put("o", func(resp *Response) {
+		if resp.DataType == rt.PT_Error {
+			result <- getError(resp.Data)
+			return
+		}
+		result <- nil
+	})
+	req := getRequest()
+	req.DataType = rt.PT_OptionReq
+	req.Data = []byte(option)
+	if err = client.write(req); err != nil {
+		client.innerHandler.remove("o")
+		return
+	}
+	select {
+	case err = <-result:
+		return
+	case <-time.After(client.ResponseTimeout):
+		client.innerHandler.remove("o")
+		return ErrLostConn
+	}
+}
+
 // Close closes the client connection.
 // Returns an error if the close operation fails.
 func (client *Client) Close() (err error) {
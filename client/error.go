@@ -7,14 +7,68 @@ import (
 )
 
 var (
-	ErrWorkWarning   = errors.New("Work warning")
-	ErrInvalidData   = errors.New("Invalid data")
-	ErrWorkFail      = errors.New("Work fail")
-	ErrWorkException = errors.New("Work exeption")
-	ErrDataType      = errors.New("Invalid data type")
-	ErrLostConn      = errors.New("Lost connection with Gearmand")
+	ErrWorkWarning    = errors.New("Work warning")
+	ErrInvalidData    = errors.New("Invalid data")
+	ErrWorkFail       = errors.New("Work fail")
+	ErrWorkException  = errors.New("Work exeption")
+	ErrDataType       = errors.New("Invalid data type")
+	ErrLostConn       = errors.New("Lost connection with Gearmand")
+	ErrQueueFull      = errors.New("Queue is full")
+	ErrUnknownFunc    = errors.New("Unknown function")
+	ErrInvalidSched   = errors.New("Invalid schedule")
+	ErrInvalidPacket  = errors.New("Invalid packet")
+	ErrUnsupported    = errors.New("Unsupported packet")
+	ErrInvalidOption  = errors.New("Invalid option")
+	ErrPacketTooLarge = errors.New("Packet too large")
+	ErrStorage        = errors.New("Storage error")
+	ErrShuttingDown   = errors.New("Server is shutting down")
 )
 
+// Error codes of ERROR packets sent by the server
+const (
+	CodeQueueError        = "QUEUE_ERROR"
+	CodeUnknownFunction   = "UNKNOWN_FUNCTION"   // the server rejects functions it doesn't know
+	CodeInvalidSchedule   = "INVALID_SCHEDULE"   // a cron expression or epoch the server can't parse
+	CodeInvalidPacket     = "INVALID_PACKET"     // wrong number of arguments or a broken header
+	CodeUnsupportedPacket = "UNSUPPORTED_PACKET" // a packet type the server doesn't handle
+	CodeUnknownOption     = "UNKNOWN_OPTION"
+	CodeInvalidOption     = "INVALID_OPTION"
+	CodeStorageError      = "STORAGE_ERROR" // the server could not store the submitted job
+	CodeShuttingDown      = "SHUTTING_DOWN" // the server takes no more jobs while it shuts down
+)
+
+// codeErrors maps the error codes to their sentinel errors.
+var codeErrors = map[string]error{
+	CodeQueueError:        ErrQueueFull,
+	CodeUnknownFunction:   ErrUnknownFunc,
+	CodeInvalidSchedule:   ErrInvalidSched,
+	CodeInvalidPacket:     ErrInvalidPacket,
+	CodeUnsupportedPacket: ErrUnsupported,
+	CodeUnknownOption:     ErrInvalidOption,
+	CodeInvalidOption:     ErrInvalidOption,
+	CodeStorageError:      ErrStorage,
+	CodeShuttingDown:      ErrShuttingDown,
+}
+
+// Error is an ERROR packet sent by the server.
+//
+// Errors with a known code match the corresponding sentinel error with
+// errors.Is, e.g. an Error with CodeQueueError matches ErrQueueFull.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports whether the error code corresponds to target.
+func (e *Error) Is(target error) bool {
+	sentinel, ok := codeErrors[e.Code]
+	return ok && target == sentinel
+}
+
 // Extract the error message
 func getError(data []byte) (err error) {
 	rel := bytes.SplitN(data, []byte{'\x00'}, 2)
@@ -22,7 +76,7 @@ func getError(data []byte) (err error) {
 		err = fmt.Errorf("Not a error data: %v", data)
 		return
 	}
-	err = fmt.Errorf("%s: %s", rel[0], rel[1])
+	err = &Error{Code: string(rel[0]), Message: string(rel[1])}
 	return
 }
 
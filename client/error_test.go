@@ -0,0 +1,33 @@
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetError(t *testing.T) {
+	err := getError([]byte("QUEUE_ERROR\x00queue of function f is full"))
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if err.Error() != "QUEUE_ERROR: queue of function f is full" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+	if err := getError([]byte("OTHER\x00message")); errors.Is(err, ErrQueueFull) {
+		t.Errorf("Unexpected ErrQueueFull for %v", err)
+	}
+	for code, sentinel := range map[string]error{
+		CodeUnknownFunction:   ErrUnknownFunc,
+		CodeInvalidSchedule:   ErrInvalidSched,
+		CodeInvalidPacket:     ErrInvalidPacket,
+		CodeUnsupportedPacket: ErrUnsupported,
+		CodeUnknownOption:     ErrInvalidOption,
+		CodeStorageError:      ErrStorage,
+		CodeShuttingDown:      ErrShuttingDown,
+	} {
+		err := getError([]byte(code + "\x00message"))
+		if !errors.Is(err, sentinel) || errors.Is(err, ErrQueueFull) {
+			t.Errorf("%v doesn't match only %v", err, sentinel)
+		}
+	}
+}
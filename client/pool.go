@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"math/rand"
 	"sync"
@@ -67,6 +68,11 @@ func NewPool() (pool *Pool) {
 
 // Add a server with rate.
 func (pool *Pool) Add(net, addr string, rate int) (err error) {
+	return pool.AddTLS(net, addr, rate, nil)
+}
+
+// Add a server with rate, connecting over TLS unless config is nil.
+func (pool *Pool) AddTLS(net, addr string, rate int, config *tls.Config) (err error) {
 	pool.mutex.Lock()
 	defer pool.mutex.Unlock()
 	var item *PoolClient
@@ -75,7 +81,7 @@ func (pool *Pool) Add(net, addr string, rate int) (err error) {
 		item.Rate = rate
 	} else {
 		var client *Client
-		client, err = New(net, addr)
+		client, err = NewTLS(net, addr, config)
 		if err == nil {
 			item = &PoolClient{Client: client, Rate: rate}
 			pool.Clients[addr] = item
@@ -80,7 +80,7 @@ func decodeResponse(data []byte) (resp *Response, l int, err error) {
 	switch resp.DataType {
 	case rt.PT_JobCreated:
 		resp.Handle = string(dt)
-	case rt.PT_StatusRes, rt.PT_WorkData, rt.PT_WorkWarning, rt.PT_WorkStatus,
+	case rt.PT_StatusRes, rt.PT_StatusResUnique, rt.PT_WorkData, rt.PT_WorkWarning, rt.PT_WorkStatus,
 		rt.PT_WorkComplete, rt.PT_WorkException:
 		s := bytes.SplitN(dt, []byte{'\x00'}, 2)
 		if len(s) >= 2 {
@@ -154,6 +154,36 @@ func (resp *Response) _status() (status *Status, err error) {
 	return
 }
 
+// status handler for STATUS_RES_UNIQUE, the handle of the response is the
+// unique id of the job
+func (resp *Response) _statusUnique() (status *Status, err error) {
+	data := bytes.SplitN(resp.Data, []byte{'\x00'}, 5)
+	if len(data) != 5 {
+		err = fmt.Errorf("Invalid data: %v", resp.Data)
+		return
+	}
+	status = &Status{}
+	status.UniqueId = resp.Handle
+	status.Known = (data[0][0] == '1')
+	status.Running = (data[1][0] == '1')
+	status.Numerator, err = strconv.ParseUint(string(data[2]), 10, 0)
+	if err != nil {
+		err = fmt.Errorf("Invalid Integer: %s", data[2])
+		return
+	}
+	status.Denominator, err = strconv.ParseUint(string(data[3]), 10, 0)
+	if err != nil {
+		err = fmt.Errorf("Invalid Integer: %s", data[3])
+		return
+	}
+	status.Clients, err = strconv.ParseUint(string(data[4]), 10, 0)
+	if err != nil {
+		err = fmt.Errorf("Invalid Integer: %s", data[4])
+		return
+	}
+	return
+}
+
 func getResponse() (resp *Response) {
 	// TODO add a pool
 	resp = &Response{}
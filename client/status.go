@@ -9,4 +9,6 @@ type Status struct {
 	Handle                 string // Job handle
 	Known, Running         bool   // Status flags
 	Numerator, Denominator uint64 // Progress information
+	UniqueId               string // Unique id, set by StatusUnique
+	Clients                uint64 // Number of clients waiting for the job, set by StatusUnique
 }
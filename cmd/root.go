@@ -46,6 +46,9 @@ Examples:
   # Start server on specific address with custom storage
   gearhulk server --addr 0.0.0.0:4730 --storage-dir /var/lib/gearhulk
 
+  # Back up the jobs of a stopped server
+  gearhulk storage export --storage-dir /var/lib/gearhulk backup.jsonl
+
   # Show help for server command
   gearhulk server --help`,
 	// When no subcommand is provided, show help
@@ -0,0 +1,512 @@
+/*
+Copyright © 2024 Dave Rawks <dave@rawks.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	"github.com/drawks/gearhulk/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	storageDir   string
+	storageOnURI string
+	listKind     string
+	listFunction string
+)
+
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Inspect and repair the storage of a stopped server",
+	Long: `Inspect, back up and repair the jobs, cron jobs and dead-lettered jobs
+persisted by a server.
+
+The commands open the storage directly, so the server must be stopped:
+LevelDB and bolt lock their files and changes made behind the back of a
+running server are overwritten by it. --storage-dir and --storage select
+the storage as for "gearhulk server".
+
+Items are addressed by their key: the handle of a job (H:...), of a cron
+job (S:...) or the handle of a dead-lettered job prefixed with D:.
+
+Examples:
+  # List the queued jobs of a function
+  gearhulk storage list --storage-dir /var/lib/gearhulk --type jobs --function resize-image
+
+  # Back up everything and restore it into another backend
+  gearhulk storage export -s /var/lib/gearhulk backup.jsonl
+  gearhulk storage import --storage sqlite:///var/lib/gearhulk/queue.db backup.jsonl
+
+  # Find and drop a record which breaks loading
+  gearhulk storage verify -s /var/lib/gearhulk
+  gearhulk storage delete -s /var/lib/gearhulk H:host:42`,
+}
+
+// itemKind is a type of stored item as named on the command line and in
+// exports.
+type itemKind struct {
+	name   string
+	prefix string
+	new    func() storage.DbItem
+	// withKey returns an item with the given key, enough to look it up.
+	withKey func(key string) storage.DbItem
+}
+
+var itemKinds = []itemKind{
+	{"job", JobPrefix, func() storage.DbItem { return &Job{} },
+		func(key string) storage.DbItem { return &Job{Handle: key} }},
+	{"cron", CronJobPrefix, func() storage.DbItem { return &CronJob{} },
+		func(key string) storage.DbItem { return &CronJob{Handle: key} }},
+	{"dead", DeadJobPrefix, func() storage.DbItem { return &DeadJob{} },
+		func(key string) storage.DbItem {
+			return &DeadJob{Job: Job{Handle: strings.TrimPrefix(key, DeadJobPrefix)}}
+		}},
+}
+
+func kindByName(name string) (itemKind, bool) {
+	for _, k := range itemKinds {
+		if k.name == name {
+			return k, true
+		}
+	}
+	return itemKind{}, false
+}
+
+func kindOfKey(key string) (itemKind, error) {
+	for _, k := range itemKinds {
+		if strings.HasPrefix(key, k.prefix) {
+			return k, nil
+		}
+	}
+	return itemKind{}, fmt.Errorf("%q is not a job (%v), cron job (%v) or dead job (%v) key", key, JobPrefix, CronJobPrefix, DeadJobPrefix)
+}
+
+// selectedKinds returns the kinds selected with --type.
+func selectedKinds() ([]itemKind, error) {
+	switch listKind {
+	case "", "all":
+		return itemKinds, nil
+	case "jobs":
+		return itemKinds[:1], nil
+	}
+	if k, ok := kindByName(strings.TrimSuffix(listKind, "s")); ok {
+		return []itemKind{k}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q, use jobs, cron, dead or all", listKind)
+}
+
+// openStorage opens the storage selected by the flags without the write
+// batching of the server, changes are written before the command returns.
+func openStorage() (storage.Db, error) {
+	uri := storageDir
+	if len(storageOnURI) > 0 {
+		uri = storageOnURI
+	}
+	db, err := storage.Open(uri)
+	if err != nil {
+		return nil, fmt.Errorf("can't open storage %v: %v (is the server still running?)", uri, err)
+	}
+	return db, nil
+}
+
+// withStorage runs fn on the opened storage and closes it.
+func withStorage(fn func(cmd *cobra.Command, args []string, db storage.Db) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		//the arguments are fine by now, don't bury the error under the usage
+		cmd.SilenceUsage = true
+		db, err := openStorage()
+		if err != nil {
+			return err
+		}
+		err = fn(cmd, args, db)
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+}
+
+func itemFunction(item storage.DbItem) string {
+	switch t := item.(type) {
+	case *Job:
+		return t.FuncName
+	case *CronJob:
+		return t.JobTemplete.FuncName
+	case *DeadJob:
+		return t.Job.FuncName
+	}
+	return ""
+}
+
+// itemSummary returns the unique id and a short description of an item.
+func itemSummary(item storage.DbItem) (string, string) {
+	switch t := item.(type) {
+	case *Job:
+		d := fmt.Sprintf("priority=%v background=%v attempts=%v", priorityName(t.Priority), t.IsBackGround, t.Attempts)
+		if len(t.CronHandle) > 0 {
+			d += " cron=" + t.CronHandle
+		}
+		return t.Id, d
+	case *CronJob:
+		return t.JobTemplete.Id, fmt.Sprintf("expression=%q runs=%v failed=%v", t.Expression, t.SuccessfulRun, t.FailedRun)
+	case *DeadJob:
+		return t.Job.Id, fmt.Sprintf("reason=%v failed_at=%v", t.Reason, t.FailedAt.Format(time.RFC3339))
+	}
+	return "", ""
+}
+
+func priorityName(p int) string {
+	switch p {
+	case JobHigh:
+		return "high"
+	case JobLow:
+		return "low"
+	}
+	return "normal"
+}
+
+var storageListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the stored items",
+	Args:  cobra.NoArgs,
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		kinds, err := selectedKinds()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TYPE\tKEY\tFUNCTION\tUNIQUE\tDETAILS")
+		for _, k := range kinds {
+			items, err := db.GetAll(k.new())
+			if err != nil {
+				return fmt.Errorf("can't read %v items: %v", k.name, err)
+			}
+			for _, item := range items {
+				fn := itemFunction(item)
+				if len(listFunction) > 0 && fn != listFunction {
+					continue
+				}
+				unique, details := itemSummary(item)
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", k.name, item.Key(), fn, unique, details)
+			}
+		}
+		return w.Flush()
+	}),
+}
+
+var storageShowCmd = &cobra.Command{
+	Use:   "show <key>",
+	Short: "Print a stored item as JSON",
+	Args:  cobra.ExactArgs(1),
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		k, err := kindOfKey(args[0])
+		if err != nil {
+			return err
+		}
+		item := k.withKey(args[0])
+		if err := db.Get(item); err != nil {
+			return fmt.Errorf("%v: %v", args[0], err)
+		}
+		e := json.NewEncoder(cmd.OutOrStdout())
+		e.SetIndent("", "  ")
+		return e.Encode(item)
+	}),
+}
+
+var storageDeleteCmd = &cobra.Command{
+	Use:   "delete <key>...",
+	Short: "Delete stored items, including records which can't be decoded",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		for _, key := range args {
+			k, err := kindOfKey(key)
+			if err != nil {
+				return err
+			}
+			//backends like mysql find a job by its columns, not by the key, so
+			//the stored item is deleted. A record which doesn't decode is
+			//still deleted by its key, that's the point.
+			item := k.withKey(key)
+			if err := db.Get(item); err == storage.ErrNotFound {
+				return fmt.Errorf("%v: %v", key, err)
+			} else if err != nil {
+				item = k.withKey(key)
+			}
+			if err := db.Delete(item); err != nil {
+				return fmt.Errorf("%v: %v", key, err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "deleted", key)
+		}
+		return nil
+	}),
+}
+
+// exportedItem is a line of an export.
+type exportedItem struct {
+	Type string          `json:"type"`
+	Item json.RawMessage `json:"item"`
+}
+
+var storageExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Write the stored items as JSON lines, to stdout without a file",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		kinds, err := selectedKinds()
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		if len(args) > 0 {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+		n := 0
+		for _, k := range kinds {
+			items, err := db.GetAll(k.new())
+			if err != nil {
+				return fmt.Errorf("can't read %v items: %v", k.name, err)
+			}
+			for _, item := range items {
+				if len(listFunction) > 0 && itemFunction(item) != listFunction {
+					continue
+				}
+				buf, err := json.Marshal(item)
+				if err != nil {
+					return err
+				}
+				line, err := json.Marshal(exportedItem{Type: k.name, Item: buf})
+				if err != nil {
+					return err
+				}
+				w.Write(line)
+				w.WriteByte('\n')
+				n++
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "exported %v items to %v\n", n, args[0])
+		}
+		return nil
+	}),
+}
+
+var storageImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Add the items of an export, from stdin without a file",
+	Long: `Add the items of an export, read from stdin without a file. Items with
+the key of a stored item replace it.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		in := cmd.InOrStdin()
+		if len(args) > 0 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		n, err := importItems(db, in)
+		fmt.Fprintf(cmd.OutOrStdout(), "imported %v items\n", n)
+		return err
+	}),
+}
+
+func importItems(db storage.Db, in io.Reader) (int, error) {
+	s := bufio.NewScanner(in)
+	s.Buffer(nil, 256*1024*1024)
+	n := 0
+	for line := 1; s.Scan(); line++ {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var e exportedItem
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("line %v: %v", line, err)
+		}
+		k, ok := kindByName(e.Type)
+		if !ok {
+			return n, fmt.Errorf("line %v: unknown item type %q", line, e.Type)
+		}
+		item := k.new()
+		if err := json.Unmarshal(e.Item, item); err != nil {
+			return n, fmt.Errorf("line %v: %v", line, err)
+		}
+		if !strings.HasPrefix(item.Key(), k.prefix) {
+			return n, fmt.Errorf("line %v: %v key %q doesn't start with %v", line, e.Type, item.Key(), k.prefix)
+		}
+		if err := db.Add(item); err != nil {
+			return n, fmt.Errorf("line %v: %v", line, err)
+		}
+		n++
+	}
+	return n, s.Err()
+}
+
+var storageCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Rewrite the stored items in the current format and reclaim space",
+	Args:  cobra.NoArgs,
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		n := 0
+		for _, k := range itemKinds {
+			items, err := db.GetAll(k.new())
+			if err != nil {
+				return fmt.Errorf("can't read %v items: %v", k.name, err)
+			}
+			for _, item := range items {
+				if err := db.Add(item); err != nil {
+					return fmt.Errorf("%v: %v", item.Key(), err)
+				}
+				n++
+			}
+		}
+		if c, ok := db.(storage.Compacter); ok {
+			if err := c.Compact(); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "rewrote %v items\n", n)
+		return nil
+	}),
+}
+
+var storageVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that the stored items can be loaded by the server",
+	Long: `Check that every stored item decodes and is consistent: jobs have a
+function, cron jobs a valid schedule and jobs started by a cron job refer to
+an existing one. Problems are printed with the key of the item, which
+"gearhulk storage delete" removes. Exits non-zero when there are problems.`,
+	Args: cobra.NoArgs,
+	RunE: withStorage(func(cmd *cobra.Command, args []string, db storage.Db) error {
+		out := cmd.OutOrStdout()
+		problems := verifyItems(db, func(key, problem string) {
+			fmt.Fprintf(out, "%v: %v\n", key, problem)
+		})
+		if problems > 0 {
+			return fmt.Errorf("%v problems found", problems)
+		}
+		fmt.Fprintln(out, "ok")
+		return nil
+	}),
+}
+
+// verifyItems reports the problems of the stored items and returns their
+// number.
+func verifyItems(db storage.Db, report func(key, problem string)) int {
+	problems := 0
+	problem := func(key, format string, args ...interface{}) {
+		problems++
+		report(key, fmt.Sprintf(format, args...))
+	}
+	items := make(map[string][]storage.DbItem)
+	for _, k := range itemKinds {
+		if s, ok := db.(storage.Scanner); ok {
+			//decode one by one to point at the records which don't decode
+			err := s.Scan(k.prefix, func(key string, value []byte) error {
+				item := k.new()
+				if err := storage.Decode(value, item); err != nil {
+					problem(key, "can't decode: %v", err)
+					return nil
+				}
+				if item.Key() != key {
+					problem(key, "stored under another key than its own %q", item.Key())
+				}
+				items[k.name] = append(items[k.name], item)
+				return nil
+			})
+			if err != nil {
+				problem(k.prefix, "can't read %v items: %v", k.name, err)
+			}
+			continue
+		}
+		all, err := db.GetAll(k.new())
+		if err != nil {
+			problem(k.prefix, "can't read %v items: %v", k.name, err)
+			continue
+		}
+		items[k.name] = all
+	}
+
+	cronJobs := make(map[string]bool)
+	for _, item := range items["cron"] {
+		cj := item.(*CronJob)
+		cronJobs[cj.Handle] = true
+		if len(cj.JobTemplete.FuncName) == 0 {
+			problem(cj.Handle, "cron job without a function")
+		}
+		if epoch := strings.TrimPrefix(cj.Expression, EpochTimePrefix); epoch != cj.Expression {
+			if _, err := strconv.ParseInt(epoch, 10, 64); err != nil {
+				problem(cj.Handle, "invalid epoch %q", cj.Expression)
+			}
+		} else if _, err := NewCronSchedule(cj.Expression); err != nil {
+			problem(cj.Handle, "invalid cron expression %q: %v", cj.Expression, err)
+		}
+	}
+	for _, item := range items["job"] {
+		j := item.(*Job)
+		if len(j.FuncName) == 0 {
+			problem(j.Handle, "job without a function")
+		}
+		if len(j.CronHandle) > 0 && !cronJobs[j.CronHandle] {
+			problem(j.Handle, "refers to the missing cron job %v", j.CronHandle)
+		}
+	}
+	for _, item := range items["dead"] {
+		dj := item.(*DeadJob)
+		if !strings.HasPrefix(dj.Job.Handle, JobPrefix) {
+			problem(dj.Key(), "dead job with the invalid handle %q", dj.Job.Handle)
+		}
+		if len(dj.Job.FuncName) == 0 {
+			problem(dj.Key(), "dead job without a function")
+		}
+	}
+	return problems
+}
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+	storageCmd.AddCommand(storageListCmd, storageShowCmd, storageDeleteCmd, storageExportCmd,
+		storageImportCmd, storageCompactCmd, storageVerifyCmd)
+
+	storageCmd.PersistentFlags().StringVarP(&storageDir, "storage-dir", "s", os.TempDir()+"/gearmand", "directory where LevelDB file is stored")
+	storageCmd.PersistentFlags().StringVar(&storageOnURI, "storage", "", "storage backend URI, takes precedence over --storage-dir")
+	for _, c := range []*cobra.Command{storageListCmd, storageExportCmd} {
+		c.Flags().StringVarP(&listKind, "type", "t", "all", "items to include: jobs, cron, dead or all")
+		c.Flags().StringVarP(&listFunction, "function", "f", "", "only include items of this function")
+	}
+}
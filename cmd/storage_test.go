@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	"github.com/drawks/gearhulk/pkg/storage"
+	"github.com/drawks/gearhulk/pkg/storage/memory"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// runStorage runs a storage subcommand on the LevelDB storage in dir.
+func runStorage(t *testing.T, dir string, args ...string) (string, error) {
+	t.Helper()
+	listKind, listFunction, storageOnURI = "all", "", ""
+	out := &bytes.Buffer{}
+	rootCmd.SetOut(out)
+	rootCmd.SetErr(out)
+	rootCmd.SetArgs(append([]string{"storage", args[0], "--storage-dir", dir}, args[1:]...))
+	defer rootCmd.SetArgs(nil)
+	err := rootCmd.Execute()
+	return out.String(), err
+}
+
+func fillStorage(t *testing.T, dir string) {
+	t.Helper()
+	db, err := storage.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now := time.Now().UTC()
+	items := []storage.DbItem{
+		&Job{Handle: JobPrefix + "1", Id: "a", FuncName: "resize", Data: []byte("x"), IsBackGround: true, CreateAt: now},
+		&Job{Handle: JobPrefix + "2", FuncName: "report", Priority: JobHigh, IsBackGround: true,
+			CronHandle: CronJobPrefix + "1", CreateAt: now},
+		&CronJob{Handle: CronJobPrefix + "1", Expression: "*/5 * * * *",
+			JobTemplete: Job{FuncName: "report", IsBackGround: true}},
+		&DeadJob{Job: Job{Handle: JobPrefix + "3", FuncName: "resize"}, Reason: "exception", FailedAt: now},
+	}
+	for _, item := range items {
+		if err := db.Add(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorageListAndShow(t *testing.T) {
+	dir := t.TempDir()
+	fillStorage(t, dir)
+
+	out, err := runStorage(t, dir, "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"H:1", "H:2", "S:1", "D:H:3"} {
+		if !strings.Contains(out, key) {
+			t.Errorf("list doesn't show %v:\n%v", key, out)
+		}
+	}
+
+	out, err = runStorage(t, dir, "list", "--type", "jobs", "--function", "resize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "H:1") || strings.Contains(out, "H:2") || strings.Contains(out, "D:H:3") {
+		t.Errorf("list of resize jobs:\n%v", out)
+	}
+
+	out, err = runStorage(t, dir, "show", "S:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"expression": "*/5 * * * *"`) {
+		t.Errorf("show S:1:\n%v", out)
+	}
+
+	if _, err := runStorage(t, dir, "show", "H:404"); err == nil {
+		t.Error("show of a missing job succeeded")
+	}
+	if _, err := runStorage(t, dir, "show", "X:1"); err == nil {
+		t.Error("show of an invalid key succeeded")
+	}
+}
+
+func TestStorageExportImport(t *testing.T) {
+	dir := t.TempDir()
+	fillStorage(t, dir)
+	file := filepath.Join(t.TempDir(), "backup.jsonl")
+
+	if _, err := runStorage(t, dir, "export", file); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(buf), "\n"); lines != 4 {
+		t.Errorf("export has %v lines:\n%s", lines, buf)
+	}
+
+	restored := t.TempDir()
+	out, err := runStorage(t, restored, "import", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "imported 4 items") {
+		t.Errorf("import: %v", out)
+	}
+	want, _ := runStorage(t, dir, "list")
+	got, _ := runStorage(t, restored, "list")
+	if got != want {
+		t.Errorf("restored storage lists\n%v\ninstead of\n%v", got, want)
+	}
+
+	out, err = runStorage(t, restored, "show", "H:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"data": "eA=="`) {
+		t.Errorf("job data isn't restored:\n%v", out)
+	}
+}
+
+func TestStorageVerifyAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	fillStorage(t, dir)
+
+	out, err := runStorage(t, dir, "verify")
+	if err != nil {
+		t.Fatalf("verify of a sound storage: %v\n%v", err, out)
+	}
+
+	raw, err := leveldb.OpenFile(dir+"/gearmand.ldb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Put([]byte(JobPrefix+"broken"), []byte{0xB7, 1, 0xff}, nil)
+	raw.Close()
+	db, err := storage.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Delete(&CronJob{Handle: CronJobPrefix + "1"})
+	db.Add(&CronJob{Handle: CronJobPrefix + "2", Expression: "every now and then",
+		JobTemplete: Job{FuncName: "report"}})
+	db.Close()
+
+	out, err = runStorage(t, dir, "verify")
+	if err == nil {
+		t.Fatalf("verify found no problems:\n%v", out)
+	}
+	for _, problem := range []string{"H:broken: can't decode", "H:2: refers to the missing cron job S:1", "S:2: invalid cron expression"} {
+		if !strings.Contains(out, problem) {
+			t.Errorf("verify doesn't report %q:\n%v", problem, out)
+		}
+	}
+
+	if _, err := runStorage(t, dir, "delete", "H:broken", "H:2", "S:2"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runStorage(t, dir, "verify"); err != nil {
+		t.Errorf("verify after delete: %v\n%v", err, out)
+	}
+	if _, err := runStorage(t, dir, "delete", "H:2"); err == nil {
+		t.Error("delete of a missing job succeeded")
+	}
+}
+
+// columnsDb deletes a job only when the function and unique id match the
+// stored ones, as the mysql and postgres backends find their rows. It is
+// opened with columns:// and keeps its items across opens.
+type columnsDb struct {
+	storage.Db
+}
+
+var columns = &columnsDb{memory.New()}
+
+func init() {
+	storage.Register("columns", func(*url.URL) (storage.Db, error) { return columns, nil })
+}
+
+func (d *columnsDb) Delete(item storage.DbItem) error {
+	if j, ok := item.(*Job); ok {
+		stored := &Job{Handle: j.Handle}
+		if err := d.Db.Get(stored); err == nil && (stored.FuncName != j.FuncName || stored.Id != j.Id) {
+			return nil
+		}
+	}
+	return d.Db.Delete(item)
+}
+
+func (d *columnsDb) Close() error { return nil }
+
+func TestStorageDeleteByColumns(t *testing.T) {
+	j := &Job{Handle: JobPrefix + "resize:a", Id: "a", FuncName: "resize", IsBackGround: true}
+	if err := columns.Db.Add(j); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runStorage(t, t.TempDir(), "delete", "--storage", "columns://", j.Handle); err != nil {
+		t.Fatalf("%v\n%v", err, out)
+	}
+	if err := columns.Db.Get(&Job{Handle: j.Handle}); err != storage.ErrNotFound {
+		t.Errorf("job still stored after delete: %v", err)
+	}
+}
+
+func TestStorageCompactMigratesRecords(t *testing.T) {
+	dir := t.TempDir()
+	raw, err := leveldb.OpenFile(dir+"/gearmand.ldb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Put([]byte(CronJobPrefix+"1"), []byte(`{"cronjob_handle":"S:1","expression":"@daily"}`), nil)
+	raw.Close()
+
+	out, err := runStorage(t, dir, "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "rewrote 1 items") {
+		t.Errorf("compact: %v", out)
+	}
+
+	raw, err = leveldb.OpenFile(dir+"/gearmand.ldb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	buf, err := raw.Get([]byte(CronJobPrefix+"1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storage.IsRecord(buf) {
+		t.Errorf("compact left %q", buf)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // GearmanAdmin communicates with a gearman server.
@@ -43,6 +44,25 @@ type Worker struct {
 	Functions []string
 }
 
+// Job represents a job known to gearman as returned by the "show jobs" command.
+type Job struct {
+	Handle    string
+	Retries   int
+	IgnoreJob bool
+	Queued    bool
+}
+
+// DeadJob represents a dead-lettered background job as returned by the "deadletter list" command.
+type DeadJob struct {
+	Handle    string
+	Function  string
+	UniqueID  string
+	Reason    string
+	Attempts  int
+	FailedAt  time.Time
+	Exception string
+}
+
 // Status returns the status of all function queues.
 func (ga GearmanAdmin) Status() ([]Status, error) {
 	var statuses []Status
@@ -146,3 +166,189 @@ func (ga GearmanAdmin) Cancel(handle string) (bool, error) {
 	}
 	return false, scanner.Err()
 }
+
+// DeadJobs returns the dead-lettered jobs of a function, or of all functions if it is empty.
+func (ga GearmanAdmin) DeadJobs(function string) ([]DeadJob, error) {
+	var deadJobs []DeadJob
+	fmt.Fprintf(ga.conn, "deadletter list %v\n", function)
+	scanner := bufio.NewScanner(ga.conn)
+	for scanner.Scan() && scanner.Text() != "." {
+		if strings.HasPrefix(scanner.Text(), "Error: ") {
+			return deadJobs, errors.New(scanner.Text())
+		}
+		toks := strings.Split(scanner.Text(), "\t")
+		if len(toks) != 7 {
+			return deadJobs, fmt.Errorf("unexpected dead job: '%v'", scanner.Text())
+		}
+		attempts, err := strconv.Atoi(toks[4])
+		if err != nil {
+			return deadJobs, fmt.Errorf("could not parse attempts: '%v'", scanner.Text())
+		}
+		failedAt, err := strconv.ParseInt(toks[5], 10, 64)
+		if err != nil {
+			return deadJobs, fmt.Errorf("could not parse failure time: '%v'", scanner.Text())
+		}
+		exception, err := strconv.Unquote(toks[6])
+		if err != nil {
+			return deadJobs, fmt.Errorf("could not parse exception: '%v'", scanner.Text())
+		}
+		deadJobs = append(deadJobs, DeadJob{
+			Handle:    toks[0],
+			Function:  toks[1],
+			UniqueID:  toks[2],
+			Reason:    toks[3],
+			Attempts:  attempts,
+			FailedAt:  time.Unix(failedAt, 0),
+			Exception: exception,
+		})
+	}
+	return deadJobs, scanner.Err()
+}
+
+// RequeueDeadJob submits a dead-lettered job again.
+func (ga GearmanAdmin) RequeueDeadJob(handle string) (bool, error) {
+	fmt.Fprintf(ga.conn, "deadletter requeue %v\n", handle)
+	return ga.readOK()
+}
+
+// PurgeDeadJobs drops a dead-lettered job, or all of them if handle is empty.
+func (ga GearmanAdmin) PurgeDeadJobs(handle string) (bool, error) {
+	fmt.Fprintf(ga.conn, "deadletter purge %v\n", handle)
+	return ga.readOK()
+}
+
+// Shutdown stops the server. A graceful shutdown waits for running jobs to finish.
+func (ga GearmanAdmin) Shutdown(graceful bool) (bool, error) {
+	if graceful {
+		fmt.Fprintf(ga.conn, "shutdown graceful\n")
+	} else {
+		fmt.Fprintf(ga.conn, "shutdown\n")
+	}
+	return ga.readOK()
+}
+
+// Drain makes the server stop handing out and accepting jobs, e.g. before it
+// is stopped. It doesn't wait for the running jobs.
+func (ga GearmanAdmin) Drain() (bool, error) {
+	fmt.Fprintf(ga.conn, "drain\n")
+	return ga.readOK()
+}
+
+// Snapshot makes the server write a snapshot of its jobs to a file on the
+// server host, for gearhulk server --restore.
+func (ga GearmanAdmin) Snapshot(path string) (bool, error) {
+	fmt.Fprintf(ga.conn, "snapshot %v\n", path)
+	return ga.readOK()
+}
+
+// ShowJobs returns the jobs known to the server.
+func (ga GearmanAdmin) ShowJobs() ([]Job, error) {
+	var jobs []Job
+	fmt.Fprintf(ga.conn, "show jobs\n")
+	scanner := bufio.NewScanner(ga.conn)
+	for scanner.Scan() && scanner.Text() != "." {
+		toks := strings.Split(scanner.Text(), "\t")
+		if len(toks) != 4 {
+			return jobs, fmt.Errorf("unexpected job: '%v'", scanner.Text())
+		}
+		retries, err := strconv.Atoi(toks[1])
+		if err != nil {
+			return jobs, fmt.Errorf("could not parse retries: '%v'", scanner.Text())
+		}
+		jobs = append(jobs, Job{
+			Handle:    toks[0],
+			Retries:   retries,
+			IgnoreJob: toks[2] != "0",
+			Queued:    toks[3] != "0",
+		})
+	}
+	return jobs, scanner.Err()
+}
+
+// ShowUniqueJobs returns the unique ids of the jobs known to the server.
+func (ga GearmanAdmin) ShowUniqueJobs() ([]string, error) {
+	var uniques []string
+	fmt.Fprintf(ga.conn, "show unique jobs\n")
+	scanner := bufio.NewScanner(ga.conn)
+	for scanner.Scan() && scanner.Text() != "." {
+		uniques = append(uniques, scanner.Text())
+	}
+	return uniques, scanner.Err()
+}
+
+// CreateFunction registers a function queue.
+func (ga GearmanAdmin) CreateFunction(function string) (bool, error) {
+	fmt.Fprintf(ga.conn, "create function %v\n", function)
+	return ga.readOK()
+}
+
+// DropFunction removes a function queue which has neither workers nor jobs.
+func (ga GearmanAdmin) DropFunction(function string) (bool, error) {
+	fmt.Fprintf(ga.conn, "drop function %v\n", function)
+	return ga.readOK()
+}
+
+// MaxQueue limits the queue size of a function. Without sizes the queue is
+// unlimited, a single size applies to all priorities, otherwise the sizes are
+// for the high, normal and low priority queue.
+func (ga GearmanAdmin) MaxQueue(function string, sizes ...int) (bool, error) {
+	cmd := "maxqueue " + function
+	for _, size := range sizes {
+		cmd += " " + strconv.Itoa(size)
+	}
+	fmt.Fprintf(ga.conn, "%v\n", cmd)
+	return ga.readOK()
+}
+
+// GetPid returns the process id of the server.
+func (ga GearmanAdmin) GetPid() (int, error) {
+	fmt.Fprintf(ga.conn, "getpid\n")
+	resp, err := ga.readOKValue()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(resp)
+}
+
+// Version returns the version of the server.
+func (ga GearmanAdmin) Version() (string, error) {
+	fmt.Fprintf(ga.conn, "version\n")
+	return ga.readOKValue()
+}
+
+// Verbose returns the log verbosity of the server.
+func (ga GearmanAdmin) Verbose() (string, error) {
+	fmt.Fprintf(ga.conn, "verbose\n")
+	return ga.readOKValue()
+}
+
+// SetVerbose changes the log verbosity of the server.
+func (ga GearmanAdmin) SetVerbose(level int) (string, error) {
+	fmt.Fprintf(ga.conn, "verbose %d\n", level)
+	return ga.readOKValue()
+}
+
+// readOKValue reads a "OK <value>" response and returns the value.
+func (ga GearmanAdmin) readOKValue() (string, error) {
+	scanner := bufio.NewScanner(ga.conn)
+	if scanner.Scan() {
+		resp := scanner.Text()
+		if strings.HasPrefix(resp, "OK ") {
+			return strings.TrimPrefix(resp, "OK "), nil
+		}
+		return "", errors.New(resp)
+	}
+	return "", scanner.Err()
+}
+
+func (ga GearmanAdmin) readOK() (bool, error) {
+	scanner := bufio.NewScanner(ga.conn)
+	if scanner.Scan() {
+		resp := scanner.Text()
+		if resp == "OK" {
+			return true, nil
+		}
+		return false, errors.New(resp)
+	}
+	return false, scanner.Err()
+}
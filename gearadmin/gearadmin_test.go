@@ -160,3 +160,132 @@ func TestCancel(t *testing.T) {
 		}
 	}
 }
+
+func TestDeadJobs(t *testing.T) {
+	mockGearmand := MockGearmand{}
+	mockGearmand.Responses = map[string]string{
+		"deadletter list fn1": "H:-icee:-17700-1483598255-1\tfn1\t*\texception\t1\t1483598300\t\"bad input\\n\"\n" +
+			"H:-icee:-17700-1483598255-2\tfn1\tid2\texhausted\t3\t1483598400\t\"\"\n.\n",
+		"deadletter requeue H:-icee:-17700-1483598255-1": "OK\n",
+		"deadletter requeue H:-icee:-17700-1483598255-3": "Error: dead job `H:-icee:-17700-1483598255-3` not found\n",
+		"deadletter purge ": "OK\n",
+	}
+	ga := GearmanAdmin{&mockGearmand}
+	deadJobs, err := ga.DeadJobs("fn1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadJobs) != 2 {
+		t.Fatalf("Expected two dead jobs, got %v", len(deadJobs))
+	}
+	if dj := deadJobs[0]; dj.Handle != "H:-icee:-17700-1483598255-1" || dj.Function != "fn1" ||
+		dj.Reason != "exception" || dj.Attempts != 1 || dj.FailedAt.Unix() != 1483598300 || dj.Exception != "bad input\n" {
+		t.Fatalf("Unexpected dead job %+v", dj)
+	}
+	if dj := deadJobs[1]; dj.UniqueID != "id2" || dj.Reason != "exhausted" || dj.Attempts != 3 || dj.Exception != "" {
+		t.Fatalf("Unexpected dead job %+v", dj)
+	}
+
+	if ok, err := ga.RequeueDeadJob("H:-icee:-17700-1483598255-1"); !ok || err != nil {
+		t.Fatalf("Expected requeue to succeed, got %v", err)
+	}
+	if ok, err := ga.RequeueDeadJob("H:-icee:-17700-1483598255-3"); ok || err == nil {
+		t.Fatalf("Expected requeue of unknown job to fail")
+	}
+	if ok, err := ga.PurgeDeadJobs(""); !ok || err != nil {
+		t.Fatalf("Expected purge to succeed, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	mockGearmand := MockGearmand{}
+	mockGearmand.Responses = map[string]string{
+		"shutdown":          "OK\n",
+		"shutdown graceful": "OK\n",
+	}
+	ga := GearmanAdmin{&mockGearmand}
+	for _, graceful := range []bool{false, true} {
+		if ok, err := ga.Shutdown(graceful); !ok || err != nil {
+			t.Fatalf("Expected shutdown (graceful: %v) to succeed, got %v", graceful, err)
+		}
+	}
+}
+
+func TestShowJobs(t *testing.T) {
+	mockGearmand := MockGearmand{}
+	mockGearmand.Responses = map[string]string{
+		"show jobs":        "H:-icee:-17700-1483598255-1\t0\t0\t1\nH:-icee:-17700-1483598255-2\t2\t0\t0\n.\n",
+		"show unique jobs": "id1\nid2\n.\n",
+	}
+	ga := GearmanAdmin{&mockGearmand}
+	jobs, err := ga.ShowJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("Expected two jobs, got %v", len(jobs))
+	}
+	if j := jobs[0]; j.Handle != "H:-icee:-17700-1483598255-1" || j.Retries != 0 || j.IgnoreJob || !j.Queued {
+		t.Fatalf("Unexpected job %+v", j)
+	}
+	if j := jobs[1]; j.Retries != 2 || j.Queued {
+		t.Fatalf("Unexpected job %+v", j)
+	}
+	uniques, err := ga.ShowUniqueJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(uniques, ",") != "id1,id2" {
+		t.Fatalf("Unexpected unique ids %v", uniques)
+	}
+}
+
+func TestFunctionCommands(t *testing.T) {
+	mockGearmand := MockGearmand{}
+	mockGearmand.Responses = map[string]string{
+		"create function fn1": "OK\n",
+		"drop function fn1":   "OK\n",
+		"drop function fn2":   "Error: there are still connected workers or executing clients\n",
+		"maxqueue fn1":        "OK\n",
+		"maxqueue fn1 10":     "OK\n",
+		"maxqueue fn1 1 2 3":  "OK\n",
+	}
+	ga := GearmanAdmin{&mockGearmand}
+	if ok, err := ga.CreateFunction("fn1"); !ok || err != nil {
+		t.Fatalf("Expected create function to succeed, got %v", err)
+	}
+	for _, sizes := range [][]int{nil, {10}, {1, 2, 3}} {
+		if ok, err := ga.MaxQueue("fn1", sizes...); !ok || err != nil {
+			t.Fatalf("Expected maxqueue %v to succeed, got %v", sizes, err)
+		}
+	}
+	if ok, err := ga.DropFunction("fn1"); !ok || err != nil {
+		t.Fatalf("Expected drop function to succeed, got %v", err)
+	}
+	if ok, err := ga.DropFunction("fn2"); ok || err == nil {
+		t.Fatalf("Expected drop function of a busy function to fail")
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	mockGearmand := MockGearmand{}
+	mockGearmand.Responses = map[string]string{
+		"getpid":    "OK 4242\n",
+		"version":   "OK 1.2.3\n",
+		"verbose":   "OK 0\n",
+		"verbose 4": "OK 4\n",
+	}
+	ga := GearmanAdmin{&mockGearmand}
+	if pid, err := ga.GetPid(); pid != 4242 || err != nil {
+		t.Fatalf("Expected pid 4242, got %v (%v)", pid, err)
+	}
+	if version, err := ga.Version(); version != "1.2.3" || err != nil {
+		t.Fatalf("Expected version 1.2.3, got %v (%v)", version, err)
+	}
+	if level, err := ga.Verbose(); level != "0" || err != nil {
+		t.Fatalf("Expected verbose 0, got %v (%v)", level, err)
+	}
+	if level, err := ga.SetVerbose(4); level != "4" || err != nil {
+		t.Fatalf("Expected verbose 4, got %v (%v)", level, err)
+	}
+}
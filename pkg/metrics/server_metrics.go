@@ -8,30 +8,67 @@ const (
 	serverNamespace = "gearman_server"
 )
 
+// ServerStats is a snapshot of the server state, all values are taken at
+// the same moment.
+type ServerStats struct {
+	Stats                 map[string]int
+	Clients               int
+	Workers               int
+	Jobs                  int
+	RunningJobsByWorker   map[string]int
+	RunningJobsByFunction map[string]int
+	JobOutcomesByFunction map[string]map[string]int
+	QueuedJobsByFunction  map[string]map[string]int
+	QueueLimitsByFunction map[string]map[string]int
+	Connections           int
+	RejectedConnections   map[string]int
+}
+
 type ServerData interface {
-	Stats() map[string]int
-	Clients() int
-	Workers() int
-	Jobs() int
-	RunningJobsByWorker() map[string]int
-	RunningJobsByFunction() map[string]int
+	ServerStats() *ServerStats
+}
+
+// serverCollector takes one snapshot per scrape and collects every metric
+// from it.
+type serverCollector struct {
+	s       ServerData
+	metrics []*serverElement
+}
+
+type serverElement struct {
+	collect func(desc *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric)
+	desc    *prometheus.Desc
+}
+
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.metrics {
+		ch <- m.desc
+	}
+}
+
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.s.ServerStats()
+	for _, m := range c.metrics {
+		m.collect(m.desc, st, ch)
+	}
 }
 
 // TODO: Add Some More Complex Matrics As Needed
 func NewServerCollector(s ServerData) prometheus.Collector {
-	return &collector{
-		metrics: []*element{
+	return &serverCollector{
+		s: s,
+		metrics: []*serverElement{
 			{
 				desc: prometheus.NewDesc(
 					prometheus.BuildFQName(serverNamespace, "", "worker_count"),
 					"Count Connected Workers",
 					nil, nil,
 				),
-				collect: func(d *prometheus.Desc, ch chan<- prometheus.Metric) {
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
 					ch <- prometheus.MustNewConstMetric(
 						d,
 						prometheus.GaugeValue,
-						float64(s.Workers()),
+						float64(st.Workers),
 					)
 				},
 			},
@@ -41,11 +78,11 @@ func NewServerCollector(s ServerData) prometheus.Collector {
 					"Count jobs",
 					nil, nil,
 				),
-				collect: func(d *prometheus.Desc, ch chan<- prometheus.Metric) {
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
 					ch <- prometheus.MustNewConstMetric(
 						d,
 						prometheus.GaugeValue,
-						float64(s.Jobs()),
+						float64(st.Jobs),
 					)
 				},
 			},
@@ -55,11 +92,11 @@ func NewServerCollector(s ServerData) prometheus.Collector {
 					"Count Connected Clients",
 					nil, nil,
 				),
-				collect: func(d *prometheus.Desc, ch chan<- prometheus.Metric) {
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
 					ch <- prometheus.MustNewConstMetric(
 						d,
 						prometheus.GaugeValue,
-						float64(s.Clients()),
+						float64(st.Clients),
 					)
 				},
 			},
@@ -69,8 +106,8 @@ func NewServerCollector(s ServerData) prometheus.Collector {
 					"Running Job By workers",
 					[]string{"worker"}, nil,
 				),
-				collect: func(d *prometheus.Desc, ch chan<- prometheus.Metric) {
-					for k, v := range s.RunningJobsByWorker() {
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for k, v := range st.RunningJobsByWorker {
 						ch <- prometheus.MustNewConstMetric(
 							d,
 							prometheus.GaugeValue,
@@ -86,8 +123,8 @@ func NewServerCollector(s ServerData) prometheus.Collector {
 					"Running job count by functions",
 					[]string{"function"}, nil,
 				),
-				collect: func(d *prometheus.Desc, ch chan<- prometheus.Metric) {
-					for k, v := range s.RunningJobsByFunction() {
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for k, v := range st.RunningJobsByFunction {
 						ch <- prometheus.MustNewConstMetric(
 							d,
 							prometheus.GaugeValue,
@@ -97,14 +134,102 @@ func NewServerCollector(s ServerData) prometheus.Collector {
 					}
 				},
 			},
+			{
+				desc: prometheus.NewDesc(
+					prometheus.BuildFQName(serverNamespace, "", "function_job_outcomes_total"),
+					"Finished, retried and rejected jobs by function and outcome",
+					[]string{"function", "outcome"}, nil,
+				),
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for fn, outcomes := range st.JobOutcomesByFunction {
+						for outcome, v := range outcomes {
+							ch <- prometheus.MustNewConstMetric(
+								d,
+								prometheus.CounterValue,
+								float64(v),
+								fn, outcome,
+							)
+						}
+					}
+				},
+			},
+			{
+				desc: prometheus.NewDesc(
+					prometheus.BuildFQName(serverNamespace, "", "function_queued_job_count"),
+					"Queued job count by function and priority",
+					[]string{"function", "priority"}, nil,
+				),
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for fn, queues := range st.QueuedJobsByFunction {
+						for priority, v := range queues {
+							ch <- prometheus.MustNewConstMetric(
+								d,
+								prometheus.GaugeValue,
+								float64(v),
+								fn, priority,
+							)
+						}
+					}
+				},
+			},
+			{
+				desc: prometheus.NewDesc(
+					prometheus.BuildFQName(serverNamespace, "", "function_max_queue"),
+					"Queue limit by function and priority, 0 is unlimited",
+					[]string{"function", "priority"}, nil,
+				),
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for fn, limits := range st.QueueLimitsByFunction {
+						for priority, v := range limits {
+							ch <- prometheus.MustNewConstMetric(
+								d,
+								prometheus.GaugeValue,
+								float64(v),
+								fn, priority,
+							)
+						}
+					}
+				},
+			},
+			{
+				desc: prometheus.NewDesc(
+					prometheus.BuildFQName(serverNamespace, "", "connection_count"),
+					"Count open connections",
+					nil, nil,
+				),
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					ch <- prometheus.MustNewConstMetric(
+						d,
+						prometheus.GaugeValue,
+						float64(st.Connections),
+					)
+				},
+			},
+			{
+				desc: prometheus.NewDesc(
+					prometheus.BuildFQName(serverNamespace, "", "rejected_connections_total"),
+					"Connections refused or closed by the server by reason",
+					[]string{"reason"}, nil,
+				),
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for k, v := range st.RejectedConnections {
+						ch <- prometheus.MustNewConstMetric(
+							d,
+							prometheus.CounterValue,
+							float64(v),
+							k,
+						)
+					}
+				},
+			},
 			{
 				desc: prometheus.NewDesc(
 					prometheus.BuildFQName(serverNamespace, "", "stats"),
 					"Running job count by functions",
 					[]string{"stats"}, nil,
 				),
-				collect: func(d *prometheus.Desc, ch chan<- prometheus.Metric) {
-					for k, v := range s.Stats() {
+				collect: func(d *prometheus.Desc, st *ServerStats, ch chan<- prometheus.Metric) {
+					for k, v := range st.Stats {
 						ch <- prometheus.MustNewConstMetric(
 							d,
 							prometheus.GaugeValue,
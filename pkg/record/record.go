@@ -0,0 +1,218 @@
+// Package record is the binary encoding of the fields of stored items.
+//
+// A field is a uvarint key, tag<<3 | wire type, followed by a varint or by a
+// uvarint length and as many bytes. Readers skip fields with unknown tags
+// and leave fields without a value at their zero value, so fields can be
+// added to and dropped from items as long as tags are never reused.
+//
+// The package has no dependencies, the framing of stored records is up to
+// the storage package.
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errTruncated = errors.New("record: truncated record")
+
+// Marshaler is implemented by items with a binary record encoding.
+type Marshaler interface {
+	MarshalRecord(w *Writer)
+}
+
+// Unmarshaler is implemented by items which decode binary records.
+type Unmarshaler interface {
+	UnmarshalRecord(r *Reader) error
+}
+
+// Append appends the fields of v to buf.
+func Append(buf []byte, v Marshaler) []byte {
+	w := &Writer{buf: buf}
+	v.MarshalRecord(w)
+	return w.buf
+}
+
+// Unmarshal decodes the fields in buf into v.
+func Unmarshal(buf []byte, v Unmarshaler) error {
+	return v.UnmarshalRecord(&Reader{buf: buf})
+}
+
+// Writer appends the fields of a record. Zero values are left out.
+type Writer struct {
+	buf []byte
+}
+
+func (w *Writer) key(tag, wire int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(tag)<<3|uint64(wire))
+}
+
+func (w *Writer) Int(tag int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.key(tag, wireVarint)
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *Writer) Bool(tag int, v bool) {
+	if v {
+		w.Int(tag, 1)
+	}
+}
+
+func (w *Writer) Bytes(tag int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.key(tag, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *Writer) String(tag int, v string) {
+	w.Bytes(tag, []byte(v))
+}
+
+func (w *Writer) Time(tag int, v time.Time) {
+	if v.IsZero() {
+		return
+	}
+	b, err := v.MarshalBinary()
+	if err != nil {
+		//only for offsets which aren't whole minutes, drop the zone
+		b, _ = v.UTC().MarshalBinary()
+	}
+	w.Bytes(tag, b)
+}
+
+// Record writes a nested record.
+func (w *Writer) Record(tag int, v Marshaler) {
+	w.Bytes(tag, Append(nil, v))
+}
+
+// Reader iterates over the fields of a record:
+//
+//	for r.Next() {
+//		switch r.Tag() {
+//		case 1:
+//			j.Handle = r.String()
+//		}
+//	}
+//	return r.Err()
+//
+// Reading a field with an accessor of another wire type, such as Int for a
+// field written with String, is an error.
+type Reader struct {
+	buf   []byte
+	tag   int
+	wire  int
+	value []byte
+	n     int64
+	err   error
+}
+
+// Next moves to the next field, it returns false at the end of the record
+// or on an error.
+func (r *Reader) Next() bool {
+	if r.err != nil || len(r.buf) == 0 {
+		return false
+	}
+	key, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errTruncated
+		return false
+	}
+	r.buf = r.buf[n:]
+	r.tag, r.wire = int(key>>3), int(key&7)
+	r.n, r.value = 0, nil
+	switch r.wire {
+	case wireVarint:
+		r.n, n = binary.Varint(r.buf)
+		if n <= 0 {
+			r.err = errTruncated
+			return false
+		}
+		r.buf = r.buf[n:]
+	case wireBytes:
+		l, n := binary.Uvarint(r.buf)
+		if n <= 0 || uint64(len(r.buf)-n) < l {
+			r.err = errTruncated
+			return false
+		}
+		r.value = r.buf[n : n+int(l)]
+		r.buf = r.buf[n+int(l):]
+	default:
+		r.err = fmt.Errorf("record: unknown wire type %v of field %v", r.wire, r.tag)
+		return false
+	}
+	return true
+}
+
+func (r *Reader) Tag() int   { return r.tag }
+func (r *Reader) Err() error { return r.err }
+
+// expect records an error unless the current field has the wire type.
+func (r *Reader) expect(wire int) bool {
+	if r.wire == wire {
+		return true
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("record: field %v has wire type %v, read as %v", r.tag, r.wire, wire)
+	}
+	return false
+}
+
+func (r *Reader) Int() int64 {
+	if !r.expect(wireVarint) {
+		return 0
+	}
+	return r.n
+}
+
+func (r *Reader) Bool() bool {
+	return r.Int() != 0
+}
+
+// Bytes returns a copy of the field.
+func (r *Reader) Bytes() []byte {
+	if !r.expect(wireBytes) {
+		return nil
+	}
+	return append([]byte(nil), r.value...)
+}
+
+func (r *Reader) String() string {
+	if !r.expect(wireBytes) {
+		return ""
+	}
+	return string(r.value)
+}
+
+func (r *Reader) Time() time.Time {
+	var t time.Time
+	if !r.expect(wireBytes) {
+		return t
+	}
+	if err := t.UnmarshalBinary(r.value); err != nil && r.err == nil {
+		r.err = err
+	}
+	return t
+}
+
+// Record decodes a nested record.
+func (r *Reader) Record(v Unmarshaler) {
+	if !r.expect(wireBytes) {
+		return
+	}
+	if err := Unmarshal(r.value, v); err != nil && r.err == nil {
+		r.err = err
+	}
+}
@@ -0,0 +1,100 @@
+package record
+
+import (
+	"testing"
+	"time"
+)
+
+type item struct {
+	Name    string
+	Count   int64
+	Done    bool
+	Data    []byte
+	At      time.Time
+	Nested  *item
+	Changed bool //written as a string by a later version
+}
+
+func (i *item) MarshalRecord(w *Writer) {
+	w.String(1, i.Name)
+	w.Int(2, i.Count)
+	w.Bool(3, i.Done)
+	w.Bytes(4, i.Data)
+	w.Time(5, i.At)
+	if i.Nested != nil {
+		w.Record(6, i.Nested)
+	}
+	w.Bool(7, i.Changed)
+}
+
+func (i *item) UnmarshalRecord(r *Reader) error {
+	for r.Next() {
+		switch r.Tag() {
+		case 1:
+			i.Name = r.String()
+		case 2:
+			i.Count = r.Int()
+		case 3:
+			i.Done = r.Bool()
+		case 4:
+			i.Data = r.Bytes()
+		case 5:
+			i.At = r.Time()
+		case 6:
+			i.Nested = &item{}
+			r.Record(i.Nested)
+		case 7:
+			i.Changed = r.Bool()
+		}
+	}
+	return r.Err()
+}
+
+// laterItem writes field 7 with another wire type, and a field item doesn't
+// know.
+type laterItem struct{ item }
+
+func (i *laterItem) MarshalRecord(w *Writer) {
+	w.String(1, i.Name)
+	w.Int(100, 42)
+	w.String(7, "yes")
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := &item{Name: "a", Count: -3, Done: true, Data: []byte{0, 1}, At: time.Unix(1700000000, 0).UTC(),
+		Nested: &item{Name: "b", Count: 1 << 40}}
+	out := &item{}
+	if err := Unmarshal(Append(nil, in), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != in.Name || out.Count != in.Count || !out.Done || string(out.Data) != string(in.Data) ||
+		!out.At.Equal(in.At) || out.Nested == nil || out.Nested.Name != "b" || out.Nested.Count != 1<<40 {
+		t.Errorf("decoded %+v from %+v", out, in)
+	}
+}
+
+func TestWireTypeMismatch(t *testing.T) {
+	buf := Append(nil, &laterItem{item{Name: "a"}})
+	out := &item{}
+	if err := Unmarshal(buf, out); err == nil {
+		t.Errorf("field read with another wire type decoded as %+v", out)
+	}
+	if out.Changed {
+		t.Error("mismatched field kept a value")
+	}
+
+	//unknown fields are skipped whatever their wire type
+	buf = Append(nil, &laterItem{item{Name: "a"}})
+	buf = buf[:len(buf)-len("yes")-2]
+	out = &item{}
+	if err := Unmarshal(buf, out); err != nil || out.Name != "a" {
+		t.Errorf("decoded %+v, %v", out, err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	buf := Append(nil, &item{Name: "name"})
+	if err := Unmarshal(buf[:len(buf)-1], &item{}); err == nil {
+		t.Error("truncated record decoded")
+	}
+}
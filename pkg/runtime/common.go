@@ -38,11 +38,17 @@ var argc = []int{
 	/* SUBMIT_JOB_LOW_BG */ 3,
 	/* SUBMIT_JOB_SCHED */ 8,
 	/* SUBMIT_JOB_EPOCH */ 4,
+	/* SUBMIT_REDUCE_JOB */ 5,
+	/* SUBMIT_REDUCE_JOB_BACKGROUND */ 5,
+	/* GRAB_JOB_ALL */ 0,
+	/* JOB_ASSIGN_ALL */ 5,
+	/* GET_STATUS_UNIQUE */ 1,
+	/* STATUS_RES_UNIQUE */ 6,
 }
 
 func (i PT) ArgCount() int {
 	switch {
-	case 1 <= i && i <= 36:
+	case 1 <= i && i <= 42:
 		return argc[i]
 	default:
 		return 0
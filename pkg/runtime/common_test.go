@@ -8,4 +8,24 @@ func TestCmdArgCount(t *testing.T) {
 	if PT_SubmitJobEpoch.ArgCount() != 4 {
 		t.Error("argument count not match")
 	}
+	if PT_SubmitReduceJob.ArgCount() != 5 || PT_JobAssignAll.ArgCount() != 5 {
+		t.Error("argument count not match")
+	}
+	if PT_GetStatusUnique.ArgCount() != 1 || PT_StatusResUnique.ArgCount() != 6 {
+		t.Error("argument count not match")
+	}
+}
+
+func TestNewPT(t *testing.T) {
+	for cmd := PT_CanDo.Uint32(); cmd <= PT_StatusResUnique.Uint32(); cmd++ {
+		if cmd == 5 { //unused
+			continue
+		}
+		if _, err := NewPT(cmd); err != nil {
+			t.Errorf("packet type %v: %v", cmd, err)
+		}
+	}
+	if _, err := NewPT(PT_StatusResUnique.Uint32() + 1); err == nil {
+		t.Error("expected error for unknown packet type")
+	}
 }
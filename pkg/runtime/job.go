@@ -5,11 +5,14 @@ import (
 )
 
 const (
-	PRIORITY_LOW  = 0
+	// Deprecated: job priorities are JobHigh, JobNormal and JobLow.
+	PRIORITY_LOW = 0
+	// Deprecated: job priorities are JobHigh, JobNormal and JobLow.
 	PRIORITY_HIGH = 1
 
 	JobPrefix       = "H:"
 	CronJobPrefix   = "S:"
+	DeadJobPrefix   = "D:"
 	EpochTimePrefix = "UTC-"
 )
 
@@ -22,13 +25,18 @@ type Job struct {
 	Denominator  int       `json:"denominator,omitempty"`
 	CreateAt     time.Time `json:"created_at,omitempty"`
 	ProcessAt    time.Time `json:"process_at,omitempty"`
-	TimeoutSec   int32     `json:"timeout_sec,omitempty"`
-	CreateBy     int64     `json:"created_by,omitempty"` //client sessionId
-	ProcessBy    int64     `json:"process_by,omitempty"` //worker sessionId
+	TimeoutSec   int32     `json:"timeout_sec,omitempty"` //run time limit of the current attempt, 0 for none
+	CreateBy     int64     `json:"created_by,omitempty"`  //client sessionId
+	ProcessBy    int64     `json:"process_by,omitempty"`  //worker sessionId
 	FuncName     string    `json:"function_name,omitempty"`
 	IsBackGround bool      `json:"is_background_job"`
 	Priority     int       `json:"priority"`
 	CronHandle   string    `json:"cronjob_handle,omitempty"`
+	Reducer      string    `json:"reducer,omitempty"`      //reducer function of SUBMIT_REDUCE_JOB
+	Attempts     int       `json:"attempts,omitempty"`     //number of times the job was handed to a worker
+	Transient    bool      `json:"transient,omitempty"`    //kept in memory only, never written to the storage
+	DeadlineSec  int32     `json:"deadline_sec,omitempty"` //run time limit chosen by the submitting client
+	Deadline     time.Time `json:"deadline,omitempty"`     //when the current attempt times out, zero for never
 }
 
 type CronJob struct {
@@ -58,3 +66,20 @@ func (c *CronJob) Key() string {
 func (c *CronJob) Prefix() string {
 	return CronJobPrefix
 }
+
+// DeadJob is a background job which failed for good, kept for inspection
+// until it is requeued or purged.
+type DeadJob struct {
+	Job       Job       `json:"job"`
+	Reason    string    `json:"reason"`              //job outcome, e.g. failed, exhausted or exception
+	Exception string    `json:"exception,omitempty"` //exception payload or failure cause
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+func (c *DeadJob) Key() string {
+	return DeadJobPrefix + c.Job.Handle
+}
+
+func (c *DeadJob) Prefix() string {
+	return DeadJobPrefix
+}
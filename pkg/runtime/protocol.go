@@ -61,6 +61,13 @@ header is:
                     34  SUBMIT_JOB_LOW_BG   REQ    Client
                     35  SUBMIT_JOB_SCHED    REQ    Client
                     36  SUBMIT_JOB_EPOCH    REQ    Client
+                    37  SUBMIT_REDUCE_JOB   REQ    Client
+                    38  SUBMIT_REDUCE_JOB_BACKGROUND
+                                            REQ    Client
+                    39  GRAB_JOB_ALL        REQ    Worker
+                    40  JOB_ASSIGN_ALL      RES    Worker
+                    41  GET_STATUS_UNIQUE   REQ    Client
+                    42  STATUS_RES_UNIQUE   RES    Client
 
 4 byte size       - A big-endian (network-order) integer containing
                     the size of the data being sent after the header.
@@ -79,13 +86,16 @@ const (
 	BufferSize = 4096
 	// min packet length
 	MinPacketLength = 12
+	// largest packet data accepted unless configured otherwise
+	DefaultMaxPacketSize = 64 << 20
 
 	// \x00REQ
 	Req    = 5391697
 	ReqStr = "\x00REQ"
 	// \x00RES
-	Res            = 5391699
-	ResStr         = "\x00RES"
+	Res    = 5391699
+	ResStr = "\x00RES"
+	// Deprecated: CAN_DO has no timeout, the server doesn't use this.
 	DefaultTimeout = 20 // 20 Seconds
 
 	HANDLE_SHAKE_HEADER_LENGTH = 12
@@ -161,7 +171,7 @@ const (
 	PT_GrabJobAll                // REQ    Worker
 	PT_JobAssignAll              // RES    Worker
 	PT_GetStatusUnique           // REQ    Client
-	PT_StatusResUnique           // RES    Client
+	PT_StatusResUnique           // 42 RES    Client
 )
 
 func (i PT) Int() int {
@@ -173,11 +183,8 @@ func (i PT) Uint32() uint32 {
 }
 
 func NewPT(cmd uint32) (PT, error) {
-	if cmd >= PT_CanDo.Uint32() && cmd <= PT_SubmitJobEpoch.Uint32() {
+	if cmd >= PT_CanDo.Uint32() && cmd <= PT_StatusResUnique.Uint32() {
 		return PT(cmd), nil
 	}
-	if cmd >= PT_SubmitReduceJob.Uint32() && cmd <= PT_StatusResUnique.Uint32() {
-		return PT(cmd), fmt.Errorf("Unsupported packet type %v", cmd)
-	}
 	return PT(cmd), fmt.Errorf("Invalid packet type %v", cmd)
 }
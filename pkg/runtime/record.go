@@ -0,0 +1,181 @@
+package runtime
+
+import (
+	"github.com/drawks/gearhulk/pkg/record"
+)
+
+// Field tags of the stored records. Tags must never be reused, retire the
+// tag of a removed field instead.
+const (
+	jobHandle = iota + 1
+	jobId
+	jobData
+	jobRunning
+	jobPercent
+	jobDenominator
+	jobCreateAt
+	jobProcessAt
+	jobTimeoutSec
+	jobCreateBy
+	jobProcessBy
+	jobFuncName
+	jobIsBackGround
+	jobPriority
+	jobCronHandle
+	jobReducer
+	jobAttempts
+	jobTransient
+	jobDeadlineSec
+	jobDeadline
+)
+
+const (
+	cronJobTemplete = iota + 1
+	cronJobHandle
+	cronJobEntryID
+	cronJobExpression
+	cronJobNext
+	cronJobPrev
+	cronJobCreated
+	cronJobSuccessfulRun
+	cronJobFailedRun
+)
+
+const (
+	deadJobJob = iota + 1
+	deadJobReason
+	deadJobException
+	deadJobFailedAt
+)
+
+func (c *Job) MarshalRecord(w *record.Writer) {
+	w.String(jobHandle, c.Handle)
+	w.String(jobId, c.Id)
+	w.Bytes(jobData, c.Data)
+	w.Bool(jobRunning, c.Running)
+	w.Int(jobPercent, int64(c.Percent))
+	w.Int(jobDenominator, int64(c.Denominator))
+	w.Time(jobCreateAt, c.CreateAt)
+	w.Time(jobProcessAt, c.ProcessAt)
+	w.Int(jobTimeoutSec, int64(c.TimeoutSec))
+	w.Int(jobCreateBy, c.CreateBy)
+	w.Int(jobProcessBy, c.ProcessBy)
+	w.String(jobFuncName, c.FuncName)
+	w.Bool(jobIsBackGround, c.IsBackGround)
+	w.Int(jobPriority, int64(c.Priority))
+	w.String(jobCronHandle, c.CronHandle)
+	w.String(jobReducer, c.Reducer)
+	w.Int(jobAttempts, int64(c.Attempts))
+	w.Bool(jobTransient, c.Transient)
+	w.Int(jobDeadlineSec, int64(c.DeadlineSec))
+	w.Time(jobDeadline, c.Deadline)
+}
+
+func (c *Job) UnmarshalRecord(r *record.Reader) error {
+	for r.Next() {
+		switch r.Tag() {
+		case jobHandle:
+			c.Handle = r.String()
+		case jobId:
+			c.Id = r.String()
+		case jobData:
+			c.Data = r.Bytes()
+		case jobRunning:
+			c.Running = r.Bool()
+		case jobPercent:
+			c.Percent = int(r.Int())
+		case jobDenominator:
+			c.Denominator = int(r.Int())
+		case jobCreateAt:
+			c.CreateAt = r.Time()
+		case jobProcessAt:
+			c.ProcessAt = r.Time()
+		case jobTimeoutSec:
+			c.TimeoutSec = int32(r.Int())
+		case jobCreateBy:
+			c.CreateBy = r.Int()
+		case jobProcessBy:
+			c.ProcessBy = r.Int()
+		case jobFuncName:
+			c.FuncName = r.String()
+		case jobIsBackGround:
+			c.IsBackGround = r.Bool()
+		case jobPriority:
+			c.Priority = int(r.Int())
+		case jobCronHandle:
+			c.CronHandle = r.String()
+		case jobReducer:
+			c.Reducer = r.String()
+		case jobAttempts:
+			c.Attempts = int(r.Int())
+		case jobTransient:
+			c.Transient = r.Bool()
+		case jobDeadlineSec:
+			c.DeadlineSec = int32(r.Int())
+		case jobDeadline:
+			c.Deadline = r.Time()
+		}
+	}
+	return r.Err()
+}
+
+func (c *CronJob) MarshalRecord(w *record.Writer) {
+	w.Record(cronJobTemplete, &c.JobTemplete)
+	w.String(cronJobHandle, c.Handle)
+	w.Int(cronJobEntryID, int64(c.CronEntryID))
+	w.String(cronJobExpression, c.Expression)
+	w.Time(cronJobNext, c.Next)
+	w.Time(cronJobPrev, c.Prev)
+	w.Int(cronJobCreated, int64(c.Created))
+	w.Int(cronJobSuccessfulRun, int64(c.SuccessfulRun))
+	w.Int(cronJobFailedRun, int64(c.FailedRun))
+}
+
+func (c *CronJob) UnmarshalRecord(r *record.Reader) error {
+	for r.Next() {
+		switch r.Tag() {
+		case cronJobTemplete:
+			r.Record(&c.JobTemplete)
+		case cronJobHandle:
+			c.Handle = r.String()
+		case cronJobEntryID:
+			c.CronEntryID = int(r.Int())
+		case cronJobExpression:
+			c.Expression = r.String()
+		case cronJobNext:
+			c.Next = r.Time()
+		case cronJobPrev:
+			c.Prev = r.Time()
+		case cronJobCreated:
+			c.Created = int(r.Int())
+		case cronJobSuccessfulRun:
+			c.SuccessfulRun = int(r.Int())
+		case cronJobFailedRun:
+			c.FailedRun = int(r.Int())
+		}
+	}
+	return r.Err()
+}
+
+func (c *DeadJob) MarshalRecord(w *record.Writer) {
+	w.Record(deadJobJob, &c.Job)
+	w.String(deadJobReason, c.Reason)
+	w.String(deadJobException, c.Exception)
+	w.Time(deadJobFailedAt, c.FailedAt)
+}
+
+func (c *DeadJob) UnmarshalRecord(r *record.Reader) error {
+	for r.Next() {
+		switch r.Tag() {
+		case deadJobJob:
+			r.Record(&c.Job)
+		case deadJobReason:
+			c.Reason = r.String()
+		case deadJobException:
+			c.Exception = r.String()
+		case deadJobFailedAt:
+			c.FailedAt = r.Time()
+		}
+	}
+	return r.Err()
+}
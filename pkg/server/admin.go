@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// Version is reported by the admin `version` command, it is set at build
+// time with -ldflags "-X github.com/drawks/gearhulk/pkg/server.Version=...".
+var Version = "dev"
+
+// handleShowJobs replies with the gearmand `show jobs` listing: handle,
+// retries, ignored and queued flag of every job.
+func (s *Server) handleShowJobs(e *event) {
+	resp := ""
+	for _, j := range s.sortedJobs() {
+		retries := 0
+		if j.Attempts > 1 {
+			retries = j.Attempts - 1
+		}
+		queued := 0
+		if !j.Running {
+			queued = 1
+		}
+		resp += fmt.Sprintf("%v\t%v\t%v\t%v\n", j.Handle, retries, 0, queued)
+	}
+	e.result <- resp + ".\n"
+}
+
+// handleShowUniqueJobs replies with the unique ids of the known jobs.
+func (s *Server) handleShowUniqueJobs(e *event) {
+	resp := ""
+	for _, j := range s.sortedJobs() {
+		if len(j.Id) > 0 {
+			resp += j.Id + "\n"
+		}
+	}
+	e.result <- resp + ".\n"
+}
+
+// sortedJobs returns the known jobs in submission order.
+func (s *Server) sortedJobs() []*Job {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		if jobs[a].CreateAt.Equal(jobs[b].CreateAt) {
+			return jobs[a].Handle < jobs[b].Handle
+		}
+		return jobs[a].CreateAt.Before(jobs[b].CreateAt)
+	})
+	return jobs
+}
+
+func (s *Server) handleCreateFunction(e *event) {
+	s.getJobWorkPair(e.handle)
+	e.result <- nil
+}
+
+// handleDropFunction forgets a function which has neither workers nor jobs.
+func (s *Server) handleDropFunction(e *event) {
+	jw, ok := s.funcWorker[e.handle]
+	if !ok {
+		e.result <- fmt.Errorf("function `%v` not found", e.handle)
+		return
+	}
+	if jw.workers.Len() > 0 || jw.jobs.Len() > 0 {
+		e.result <- fmt.Errorf("there are still connected workers or executing clients")
+		return
+	}
+	for _, j := range s.jobs {
+		if j.FuncName == e.handle {
+			e.result <- fmt.Errorf("there are still connected workers or executing clients")
+			return
+		}
+	}
+	delete(s.funcWorker, e.handle)
+	delete(s.maxQueue, e.handle)
+	e.result <- nil
+}
+
+// handleMaxQueue sets the queue limit of a function, for the admin
+// `maxqueue` command and the REST API.
+func (s *Server) handleMaxQueue(e *event) {
+	s.getJobWorkPair(e.handle)
+	s.maxQueue[e.handle] = e.args.t0.(QueueLimit)
+	e.result <- nil
+}
+
+// handleStatus replies with the gearmand `status` listing: function, queued
+// jobs, running jobs and workers.
+func (s *Server) handleStatus(e *event) {
+	resp := ""
+	for fnName, v := range s.funcWorker {
+		runningCnt := 0
+		for _, j := range s.jobs {
+			if fnName == j.FuncName && j.Running {
+				runningCnt++
+			}
+		}
+		resp += fmt.Sprintf("%v\t%v\t%v\t%v\n", fnName, v.jobs.Len(), runningCnt, v.workers.Len())
+	}
+	e.result <- resp + ".\n"
+}
+
+// handlePriorityStatus replies with the queued jobs of every function per
+// priority.
+func (s *Server) handlePriorityStatus(e *event) {
+	resp := ""
+	for fnName, v := range s.funcWorker {
+		resp += fmt.Sprintf("%v\t%v\t%v\t%v\t%v\n", fnName,
+			v.jobs.LenByPriority(JobHigh), v.jobs.LenByPriority(JobNormal),
+			v.jobs.LenByPriority(JobLow), v.workers.Len())
+	}
+	e.result <- resp + ".\n"
+}
+
+// handleWorkers replies with the gearmand `workers` listing.
+func (s *Server) handleWorkers(e *event) {
+	resp := ""
+	for _, v := range s.worker {
+		resp += fmt.Sprintf("%v %v %v : ", "-", v.Conn.RemoteAddr().String(), v.workerId)
+		isFirst := true
+		for fnName := range v.canDo {
+			if !isFirst {
+				resp += " "
+			}
+			isFirst = false
+			resp += fmt.Sprintf("%v", fnName)
+		}
+		resp += "\n"
+	}
+	e.result <- resp + ".\n"
+}
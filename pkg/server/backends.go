@@ -0,0 +1,10 @@
+package server
+
+// Storage backends available to Config.Storage URIs.
+import (
+	_ "github.com/drawks/gearhulk/pkg/storage/boltdb"
+	_ "github.com/drawks/gearhulk/pkg/storage/leveldb"
+	_ "github.com/drawks/gearhulk/pkg/storage/memory"
+	_ "github.com/drawks/gearhulk/pkg/storage/sqldb"
+	_ "github.com/drawks/gearhulk/pkg/storage/sqlite"
+)
@@ -12,6 +12,13 @@ type Session struct {
 
 type Client struct {
 	Session
+
+	persist Persistence //set with OPTION_REQ, replaces the configured persistence
+	timeout int32       //run time limit in seconds of the jobs it submits, set with OPTION_REQ
+
+	exceptions bool  //WORK_EXCEPTION is forwarded, set with OPTION_REQ by the event loop
+	waiting    int32 //foreground jobs it waits for, the session reads it atomically
+	doneAt     int64 //unix nanoseconds its last waited for job ended, read atomically
 }
 
 func (s *Session) Send(data []byte) bool {
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/drawks/gearhulk/client"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	"github.com/drawks/gearhulk/worker"
+)
+
+// newTestClient connects a client of the client package to addr.
+func newTestClient(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	c, err := client.New(Network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ErrorHandler = func(err error) { t.Log("client:", err) }
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientReduceJobs(t *testing.T) {
+	s := newTestServer(t)
+	addr := listenTest(t, s)
+
+	type grabbed struct{ reducer, data string }
+	jobs := make(chan grabbed, 1)
+	// The job runs until the worker is closed, so no packet reaches the
+	// worker while Close shuts its channels.
+	done := make(chan struct{})
+	defer close(done)
+	w := worker.New(worker.OneByOne)
+	defer w.Close()
+	w.GrabAll = true
+	if err := w.AddServer(Network, addr); err != nil {
+		t.Fatal(err)
+	}
+	w.AddFunc("count", func(job worker.Job) ([]byte, error) {
+		rj, ok := job.(worker.ReduceJob)
+		if !ok {
+			t.Error("job doesn't give its reducer")
+			return nil, nil
+		}
+		jobs <- grabbed{rj.Reducer(), string(job.Data())}
+		<-done
+		return nil, nil
+	}, worker.Unlimited)
+	if err := w.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	go w.Work()
+
+	c := newTestClient(t, addr)
+	handle, err := c.DoReduceBg("count", "sum", []byte("abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handle) == 0 {
+		t.Error("handle is empty")
+	}
+	select {
+	case job := <-jobs:
+		if job.reducer != "sum" || job.data != "abcdef" {
+			t.Errorf("unexpected job %+v", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not grabbed")
+	}
+
+	status, err := c.StatusUnique("unique not exists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UniqueId != "unique not exists" || status.Known || status.Running || status.Clients != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestClientQueueFull(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"full": {MaxQueue: QueueLimit{Normal: 1}},
+		},
+	})
+	c := newTestClient(t, listenTest(t, s))
+
+	if _, err := c.DoBg("full", []byte("abcdef"), JobNormal); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.DoBg("full", []byte("abcdef"), JobNormal)
+	if !errors.Is(err, client.ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	var e *client.Error
+	if !errors.As(err, &e) || e.Code != client.CodeQueueError {
+		t.Errorf("unexpected error %#v", err)
+	}
+	// A foreground job gets the same error instead of waiting for a result
+	// which will never come.
+	_, err = c.Do("full", []byte("abcdef"), JobNormal, nil)
+	if !errors.Is(err, client.ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestClientSetOption(t *testing.T) {
+	c := newTestClient(t, listenTest(t, newTestServer(t)))
+	if err := c.SetOption("exceptions"); err != nil {
+		t.Fatal(err)
+	}
+	var e *client.Error
+	if err := c.SetOption("nosuchoption"); !errors.As(err, &e) || e.Code != "UNKNOWN_OPTION" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// FunctionConfig holds the server settings applied to the jobs of a function.
+type FunctionConfig struct {
+	Retry    RetryPolicy   `mapstructure:"retry" json:"retry"`               // Retry policy for failed and timed-out jobs
+	MaxQueue QueueLimit    `mapstructure:"max-queue" json:"max_queue"`       // Limit of queued jobs, submissions beyond it are rejected
+	Persist  Persistence   `mapstructure:"persist" json:"persist,omitempty"` // Which jobs are written to the storage
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout,omitempty"` // Run time limit of jobs whose worker and client set none
+}
+
+// RetryPolicy controls how often a job that failed or timed out is run again.
+//
+// A job is attempted at most MaxAttempts times, values below 2 disable
+// retries. The n-th retry waits Backoff * 2^(n-1), capped at MaxBackoff
+// when it is set.
+type RetryPolicy struct {
+	MaxAttempts int           `mapstructure:"max-attempts" json:"max_attempts,omitempty"`
+	Backoff     time.Duration `mapstructure:"backoff" json:"backoff,omitempty"`
+	MaxBackoff  time.Duration `mapstructure:"max-backoff" json:"max_backoff,omitempty"`
+}
+
+// Enabled reports whether the policy retries failed jobs at all.
+func (p RetryPolicy) Enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+// Delay returns how long to wait before running a job again which failed
+// after the given number of attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempts && d > 0 && d < math.MaxInt64/2; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// merge returns c with every setting that is set in o overridden.
+func (c FunctionConfig) merge(o FunctionConfig) FunctionConfig {
+	if o.Retry.MaxAttempts != 0 {
+		c.Retry.MaxAttempts = o.Retry.MaxAttempts
+	}
+	if o.Retry.Backoff != 0 {
+		c.Retry.Backoff = o.Retry.Backoff
+	}
+	if o.Retry.MaxBackoff != 0 {
+		c.Retry.MaxBackoff = o.Retry.MaxBackoff
+	}
+	if o.MaxQueue.High != 0 {
+		c.MaxQueue.High = o.MaxQueue.High
+	}
+	if o.MaxQueue.Normal != 0 {
+		c.MaxQueue.Normal = o.MaxQueue.Normal
+	}
+	if o.MaxQueue.Low != 0 {
+		c.MaxQueue.Low = o.MaxQueue.Low
+	}
+	if len(o.Persist) > 0 {
+		c.Persist = o.Persist
+	}
+	if o.Timeout != 0 {
+		c.Timeout = o.Timeout
+	}
+	return c
+}
+
+// functionConfig returns the settings for a function, FunctionDefaults
+// overridden by its entry in Functions.
+func (s *Server) functionConfig(funcName string) FunctionConfig {
+	if fc, ok := s.config.Functions[funcName]; ok {
+		return s.config.FunctionDefaults.merge(fc)
+	}
+	return s.config.FunctionDefaults
+}
+
+// QueueLimit caps the number of queued jobs of a function per priority,
+// 0 means unlimited.
+type QueueLimit struct {
+	High   int `mapstructure:"high" json:"high,omitempty"`
+	Normal int `mapstructure:"normal" json:"normal,omitempty"`
+	Low    int `mapstructure:"low" json:"low,omitempty"`
+}
+
+// forPriority returns the limit of the queue of the given job priority.
+func (l QueueLimit) forPriority(priority int) int {
+	switch priority {
+	case JobHigh:
+		return l.High
+	case JobLow:
+		return l.Low
+	}
+	return l.Normal
+}
+
+// queueLimit returns the queue limit of a function. A limit set with the
+// admin maxqueue command or the REST API replaces the configured one.
+func (s *Server) queueLimit(funcName string) QueueLimit {
+	if l, ok := s.maxQueue[funcName]; ok {
+		return l
+	}
+	return s.functionConfig(funcName).MaxQueue
+}
+
+// queueFull reports whether a function can't queue another job of the
+// given priority.
+func (s *Server) queueFull(funcName string, priority int) bool {
+	limit := s.queueLimit(funcName).forPriority(priority)
+	if limit <= 0 {
+		return false
+	}
+	jw, ok := s.funcWorker[funcName]
+	return ok && jw.jobs.LenByPriority(priority) >= limit
+}
+
+// checkFunction returns the error a submission for funcName is rejected
+// with when RejectUnknownFunctions is set and neither a worker, the admin
+// `create function` command nor the config made the function known.
+func (s *Server) checkFunction(funcName string) *codedError {
+	if !s.config.RejectUnknownFunctions {
+		return nil
+	}
+	if _, ok := s.funcWorker[funcName]; ok {
+		return nil
+	}
+	if _, ok := s.config.Functions[funcName]; ok {
+		return nil
+	}
+	return &codedError{code: "UNKNOWN_FUNCTION", msg: fmt.Sprintf("function %v is unknown", funcName)}
+}
+
+// Persistence selects which jobs of a function are written to the storage.
+// Foreground jobs are kept in memory by default, their results need the
+// connection of the client which a restart breaks anyway.
+type Persistence string
+
+const (
+	PersistBackground Persistence = "background" // only background jobs, the default
+	PersistAll        Persistence = "all"        // foreground jobs too
+	PersistNone       Persistence = "none"       // no jobs at all
+)
+
+// persistent reports whether a new job is written to the storage. A
+// persistence chosen by the submitting client with OPTION_REQ replaces the
+// configured one, c is nil for jobs which no client submitted.
+func (s *Server) persistent(j *Job, c *Client) bool {
+	p := s.functionConfig(j.FuncName).Persist
+	if c != nil && len(c.persist) > 0 {
+		p = c.persist
+	}
+	switch p {
+	case PersistAll:
+		return true
+	case PersistNone:
+		return false
+	}
+	return j.IsBackGround
+}
+
+// jobTimeout returns the run time limit of a job handed to a worker, 0 for
+// none. The limit chosen by the submitting client wins over the one the
+// worker declared with CAN_DO_TIMEOUT, which wins over the function config.
+func (s *Server) jobTimeout(j *Job, w *Worker) time.Duration {
+	if j.DeadlineSec > 0 {
+		return time.Duration(j.DeadlineSec) * time.Second
+	}
+	if timeout := w.canDo[j.FuncName]; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return s.functionConfig(j.FuncName).Timeout
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/appscode/go/log"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// deadLetter keeps a background job which failed for good. Foreground jobs
+// are not kept, their clients already got the failure.
+func (s *Server) deadLetter(j *Job, reason, exception string) {
+	if !j.IsBackGround {
+		return
+	}
+	dj := &DeadJob{Job: *j, Reason: reason, Exception: exception, FailedAt: time.Now()}
+	dj.Job.Running = false
+	dj.Job.Deadline = time.Time{}
+	dj.Job.ProcessBy = 0
+	s.deadJobs[j.Handle] = dj
+	log.Infof("job %v dead-lettered: %v", j.Handle, reason)
+	if s.store == nil || j.Transient {
+		return
+	}
+	if err := s.store.Add(dj); err != nil {
+		log.Warning(err)
+	}
+}
+
+func (s *Server) loadAllDeadJobs() {
+	if s.store == nil {
+		return
+	}
+	deadJobs, err := s.store.GetAll(&DeadJob{})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, dji := range deadJobs {
+		dj, ok := dji.(*DeadJob)
+		if !ok {
+			log.Errorln("invalid dead job")
+			continue
+		}
+		s.deadJobs[dj.Job.Handle] = dj
+	}
+}
+
+// handleGetDeadJob replies with copies of the dead jobs, oldest failure first.
+// The event handle selects a single job, args.t0 a function.
+func (s *Server) handleGetDeadJob(e *event) {
+	funcName := ""
+	if e.args != nil {
+		funcName, _ = e.args.t0.(string)
+	}
+	deadJobs := make([]*DeadJob, 0)
+	for handle, dj := range s.deadJobs {
+		if len(e.handle) > 0 && handle != e.handle {
+			continue
+		}
+		if len(funcName) > 0 && dj.Job.FuncName != funcName {
+			continue
+		}
+		c := *dj
+		deadJobs = append(deadJobs, &c)
+	}
+	sort.Slice(deadJobs, func(a, b int) bool {
+		return deadJobs[a].FailedAt.Before(deadJobs[b].FailedAt)
+	})
+	e.result <- deadJobs
+}
+
+// handleRequeueDeadJob submits a dead job again under its original handle
+// and replies with an error if there is no such dead job.
+func (s *Server) handleRequeueDeadJob(e *event) {
+	dj, ok := s.deadJobs[e.handle]
+	if !ok {
+		e.result <- fmt.Errorf("dead job `%v` not found", e.handle)
+		return
+	}
+	if _, ok := s.jobs[e.handle]; ok {
+		e.result <- fmt.Errorf("job `%v` is already queued", e.handle)
+		return
+	}
+	s.removeDeadJob(dj)
+	j := dj.Job
+	j.Running = false
+	j.Deadline = time.Time{}
+	j.Attempts = 0
+	j.Percent, j.Denominator = 0, 0
+	j.CreateBy = 0
+	s.doAddJob(&j)
+	log.Infof("dead job %v requeued", j.Handle)
+	e.result <- nil
+}
+
+// handlePurgeDeadJob drops the dead job with the event handle, or all dead
+// jobs if it is empty, and replies with the number of purged jobs.
+func (s *Server) handlePurgeDeadJob(e *event) {
+	if len(e.handle) > 0 {
+		dj, ok := s.deadJobs[e.handle]
+		if !ok {
+			e.result <- fmt.Errorf("dead job `%v` not found", e.handle)
+			return
+		}
+		s.removeDeadJob(dj)
+		e.result <- 1
+		return
+	}
+	n := 0
+	for _, dj := range s.deadJobs {
+		s.removeDeadJob(dj)
+		n++
+	}
+	e.result <- n
+}
+
+func (s *Server) removeDeadJob(dj *DeadJob) {
+	delete(s.deadJobs, dj.Job.Handle)
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Delete(dj); err != nil {
+		log.Warning(err)
+	}
+}
+
+// formatDeadJob renders a dead job as a line of the admin protocol.
+func formatDeadJob(dj *DeadJob) string {
+	unique := dj.Job.Id
+	if unique == "" {
+		unique = "*"
+	}
+	return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%q\n", dj.Job.Handle, dj.Job.FuncName,
+		unique, dj.Reason, dj.Job.Attempts, dj.FailedAt.Unix(), dj.Exception)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"container/heap"
+	"time"
+)
+
+// deadlineQueue orders the deadlines of running jobs, earliest first. It is
+// owned by the event loop, which selects on C to time out the jobs whose
+// deadline passed.
+type deadlineQueue struct {
+	heap  deadlineHeap
+	index map[string]*deadline //job handle -> its entry
+	timer *time.Timer
+}
+
+type deadline struct {
+	handle string
+	at     time.Time
+	i      int //position in the heap
+}
+
+func newDeadlineQueue() *deadlineQueue {
+	q := &deadlineQueue{index: make(map[string]*deadline), timer: time.NewTimer(time.Hour)}
+	q.timer.Stop()
+	return q
+}
+
+// C fires when the earliest deadline may have passed.
+func (q *deadlineQueue) C() <-chan time.Time {
+	return q.timer.C
+}
+
+func (q *deadlineQueue) Len() int {
+	return len(q.heap)
+}
+
+// add sets the deadline of a job, replacing the one it had.
+func (q *deadlineQueue) add(handle string, at time.Time) {
+	if d, ok := q.index[handle]; ok {
+		d.at = at
+		heap.Fix(&q.heap, d.i)
+	} else {
+		d = &deadline{handle: handle, at: at}
+		q.index[handle] = d
+		heap.Push(&q.heap, d)
+	}
+	if q.heap[0].handle == handle {
+		q.arm()
+	}
+}
+
+// remove drops the deadline of a job which stopped running. The timer is
+// left as is, firing early only costs an empty expired call.
+func (q *deadlineQueue) remove(handle string) {
+	if d, ok := q.index[handle]; ok {
+		heap.Remove(&q.heap, d.i)
+		delete(q.index, handle)
+	}
+}
+
+// expired removes and returns the handles of the jobs whose deadline is not
+// after now, earliest first, and arms the timer for the next deadline.
+func (q *deadlineQueue) expired(now time.Time) []string {
+	var handles []string
+	for len(q.heap) > 0 && !q.heap[0].at.After(now) {
+		d := heap.Pop(&q.heap).(*deadline)
+		delete(q.index, d.handle)
+		handles = append(handles, d.handle)
+	}
+	q.arm()
+	return handles
+}
+
+func (q *deadlineQueue) arm() {
+	if len(q.heap) == 0 {
+		q.timer.Stop()
+		return
+	}
+	q.timer.Reset(time.Until(q.heap[0].at))
+}
+
+// deadlineHeap implements heap.Interface for deadlineQueue.
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(a, b int) bool { return h[a].at.Before(h[b].at) }
+
+func (h deadlineHeap) Swap(a, b int) {
+	h[a], h[b] = h[b], h[a]
+	h[a].i = a
+	h[b].i = b
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	d := x.(*deadline)
+	d.i = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeadlineQueue(t *testing.T) {
+	q := newDeadlineQueue()
+	now := time.Now()
+	q.add("c", now.Add(3*time.Second))
+	q.add("a", now.Add(time.Second))
+	q.add("b", now.Add(2*time.Second))
+	q.add("d", now.Add(4*time.Second))
+	q.add("e", now.Add(5*time.Second))
+	q.remove("b")
+	q.remove("unknown")
+	q.add("e", now.Add(-time.Second)) //moved before all others
+
+	if got := q.expired(now); !reflect.DeepEqual(got, []string{"e"}) {
+		t.Errorf("expired %v at now", got)
+	}
+	if got := q.expired(now.Add(3 * time.Second)); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("expired %v after 3s", got)
+	}
+	if q.Len() != 1 || len(q.index) != 1 {
+		t.Errorf("%v deadlines left, %v indexed", q.Len(), len(q.index))
+	}
+	q.remove("d")
+	if got := q.expired(now.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("expired removed deadlines %v", got)
+	}
+}
+
+func TestDeadlineQueueTimer(t *testing.T) {
+	q := newDeadlineQueue()
+	q.add("late", time.Now().Add(time.Hour))
+	q.add("soon", time.Now().Add(10*time.Millisecond))
+	select {
+	case now := <-q.C():
+		if got := q.expired(now); !reflect.DeepEqual(got, []string{"soon"}) {
+			t.Errorf("expired %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer didn't fire for the earliest deadline")
+	}
+	select {
+	case <-q.C():
+		t.Error("timer fired for a deadline an hour away")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/appscode/go/log"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// reasons connections are rejected or closed by the server, counted for
+// the metrics
+const (
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+	rejectPacketTooLarge      = "packet_too_large"
+	rejectIdleTimeout         = "idle_timeout"
+	rejectReadTimeout         = "read_timeout"
+)
+
+var (
+	idleTimeout = &codedError{code: "IDLE_TIMEOUT", msg: "no request within the idle timeout"}
+	readTimeout = &codedError{code: "READ_TIMEOUT", msg: "request not complete within the read timeout"}
+)
+
+// connLimiter counts the open connections, in total and per remote IP. It
+// is shared by the accept loop and the sessions, not owned by the event loop.
+type connLimiter struct {
+	mu       sync.Mutex
+	max      int //0 for no limit
+	maxPerIP int //0 for no limit
+	total    int
+	perIP    map[string]int
+	rejected map[string]int64 //reason -> count
+}
+
+func newConnLimiter(max, maxPerIP int) *connLimiter {
+	return &connLimiter{
+		max:      max,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+		rejected: make(map[string]int64),
+	}
+}
+
+// acquire counts a new connection from ip, or returns why it is rejected.
+func (l *connLimiter) acquire(ip string) *codedError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		l.rejected[rejectMaxConnections]++
+		return &codedError{code: "TOO_MANY_CONNECTIONS", msg: fmt.Sprintf("server has %v connections", l.total)}
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		l.rejected[rejectMaxConnectionsPerIP]++
+		return &codedError{code: "TOO_MANY_CONNECTIONS", msg: fmt.Sprintf("%v has %v connections", ip, l.perIP[ip])}
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+// release forgets a connection counted by acquire.
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// reject counts a connection the server closed.
+func (l *connLimiter) reject(reason string) {
+	l.mu.Lock()
+	l.rejected[reason]++
+	l.mu.Unlock()
+}
+
+// stats returns the open connections and the rejections by reason.
+func (l *connLimiter) stats() (int, map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rejected := make(map[string]int, len(l.rejected))
+	for reason, n := range l.rejected {
+		rejected[reason] = int(n)
+	}
+	return l.total, rejected
+}
+
+// remoteIP returns the IP address of the peer of conn.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// refuseConnection answers a connection which exceeds a limit with an
+// ERROR packet, or an error line for the admin protocol, and closes it.
+func refuseConnection(conn net.Conn, err *codedError) {
+	defer conn.Close()
+	log.Warningf("connection from %v refused: %v", conn.RemoteAddr(), err)
+	//the first byte tells the protocol, don't wait long for it
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fb, perr := bufio.NewReader(conn).Peek(1)
+	if perr == nil && fb[0] != byte(0) {
+		conn.Write([]byte(fmt.Sprintf("Error: %v\n", err.msg)))
+		return
+	}
+	conn.Write(errorReply(err))
+}
+
+// maxPacketSize returns the largest packet data the sessions accept.
+func (s *Server) maxPacketSize() int {
+	if s.config.MaxPacketSize > 0 {
+		return s.config.MaxPacketSize
+	}
+	return DefaultMaxPacketSize
+}
+
+// waitRequest waits until the next request of the session starts to arrive,
+// at most the idle timeout of the server. Workers and clients waiting for
+// their jobs are not idle, a client is idle from when its last job ended.
+// The rest of the request has to arrive within the read timeout.
+func (se *session) waitRequest(s *Server, conn net.Conn, r *bufio.Reader) error {
+	deadline := time.Time{}
+	if s.config.IdleTimeout > 0 {
+		deadline = time.Now().Add(s.config.IdleTimeout)
+	}
+	for {
+		//without an idle timeout, the read deadline of the previous request
+		//must not carry over
+		conn.SetReadDeadline(deadline)
+		_, err := r.Peek(1)
+		if err == nil {
+			break
+		}
+		if !isTimeout(err) || s.config.IdleTimeout == 0 {
+			return err
+		}
+		if se.busy() {
+			deadline = time.Now().Add(s.config.IdleTimeout)
+			continue
+		}
+		if idle := se.idleSince().Add(s.config.IdleTimeout); idle.After(time.Now()) {
+			deadline = idle
+			continue
+		}
+		s.conns.reject(rejectIdleTimeout)
+		return idleTimeout
+	}
+	if s.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// busy reports whether the session waits for the server rather than the
+// other way round: a worker running jobs or asleep until a NOOP, a client
+// waiting for its jobs. A worker which only registered its functions is idle.
+func (se *session) busy() bool {
+	return (se.w != nil && atomic.LoadInt32(&se.w.busy) > 0) ||
+		(se.c != nil && atomic.LoadInt32(&se.c.waiting) > 0)
+}
+
+// idleSince returns when the last job the client waited for ended.
+func (se *session) idleSince() time.Time {
+	if se.c == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, atomic.LoadInt64(&se.c.doneAt))
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// closeWithError writes a last reply before the session ends. It bypasses
+// the queue of the writer, which drops what is left when the session ends.
+func closeWithError(conn net.Conn, reply []byte) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(reply)
+}
@@ -1,44 +1,113 @@
 package server
 
-func (s *Server) Stats() map[string]int {
-	ret := map[string]int{
-		"proto_evt_ch":   len(s.protoEvtCh),
-		"forward_report": int(s.forwardReport),
-		"queue_count":    len(s.funcWorker),
-		"job_queue":      len(s.jobs),
+import (
+	"github.com/drawks/gearhulk/pkg/metrics"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// ServerStats asks the event loop for a snapshot of the state. It is safe
+// to call from any goroutine such as the one of a Prometheus scrape, which
+// takes one snapshot for all metrics.
+func (s *Server) ServerStats() *metrics.ServerStats {
+	e := &event{tp: ctrlStats, result: createResCh()}
+	s.ctrlEvtCh <- e
+	return (<-e.result).(*metrics.ServerStats)
+}
+
+func (s *Server) handleStats(e *event) {
+	st := &metrics.ServerStats{
+		Stats: map[string]int{
+			"proto_evt_ch":   len(s.protoEvtCh),
+			"forward_report": int(s.forwardReport),
+			"queue_count":    len(s.funcWorker),
+			"job_queue":      len(s.jobs),
+		},
+		Workers:               len(s.worker),
+		Clients:               len(s.client),
+		RunningJobsByWorker:   make(map[string]int),
+		RunningJobsByFunction: make(map[string]int),
+		JobOutcomesByFunction: make(map[string]map[string]int),
+		QueuedJobsByFunction:  make(map[string]map[string]int),
+		QueueLimitsByFunction: make(map[string]map[string]int),
 	}
 	for k, v := range s.opCounter {
-		ret[k.String()] = int(v)
+		st.Stats[k.String()] = int(v)
 	}
-	return ret
+	s.mu.RLock()
+	st.Jobs = len(s.jobs) + len(s.cronJobs)
+	s.mu.RUnlock()
+	st.Connections, st.RejectedConnections = s.conns.stats()
+	for _, worker := range s.worker {
+		st.RunningJobsByWorker[worker.workerId] += len(worker.runningJobs)
+		for _, job := range worker.runningJobs {
+			st.RunningJobsByFunction[job.FuncName]++
+		}
+	}
+	for funcName, counts := range s.outcomes {
+		st.JobOutcomesByFunction[funcName] = make(map[string]int)
+		for outcome, n := range counts {
+			st.JobOutcomesByFunction[funcName][outcome] = int(n)
+		}
+	}
+	for funcName, jw := range s.funcWorker {
+		st.QueuedJobsByFunction[funcName] = map[string]int{
+			"high":   jw.jobs.LenByPriority(JobHigh),
+			"normal": jw.jobs.LenByPriority(JobNormal),
+			"low":    jw.jobs.LenByPriority(JobLow),
+		}
+		limit := s.queueLimit(funcName)
+		st.QueueLimitsByFunction[funcName] = map[string]int{
+			"high":   limit.High,
+			"normal": limit.Normal,
+			"low":    limit.Low,
+		}
+	}
+	e.result <- st
+}
+
+// The methods below each take their own snapshot, use ServerStats to read
+// several values of the same moment.
+
+func (s *Server) Stats() map[string]int {
+	return s.ServerStats().Stats
 }
 
 func (s *Server) Workers() int {
-	return len(s.worker)
+	return s.ServerStats().Workers
 }
 
 func (s *Server) Jobs() int {
-	return len(s.jobs) + len(s.cronJobs)
+	return s.ServerStats().Jobs
 }
 
 func (s *Server) Clients() int {
-	return len(s.client)
+	return s.ServerStats().Clients
 }
 
 func (s *Server) RunningJobsByWorker() map[string]int {
-	ret := make(map[string]int)
-	for _, worker := range s.worker {
-		ret[worker.workerId] += len(worker.runningJobs)
-	}
-	return ret
+	return s.ServerStats().RunningJobsByWorker
 }
 
 func (s *Server) RunningJobsByFunction() map[string]int {
-	ret := make(map[string]int)
-	for _, worker := range s.worker {
-		for _, job := range worker.runningJobs {
-			ret[job.FuncName]++
-		}
-	}
-	return ret
+	return s.ServerStats().RunningJobsByFunction
+}
+
+func (s *Server) JobOutcomesByFunction() map[string]map[string]int {
+	return s.ServerStats().JobOutcomesByFunction
+}
+
+func (s *Server) QueuedJobsByFunction() map[string]map[string]int {
+	return s.ServerStats().QueuedJobsByFunction
+}
+
+func (s *Server) QueueLimitsByFunction() map[string]map[string]int {
+	return s.ServerStats().QueueLimitsByFunction
+}
+
+func (s *Server) Connections() int {
+	return s.ServerStats().Connections
+}
+
+func (s *Server) RejectedConnections() map[string]int {
+	return s.ServerStats().RejectedConnections
 }
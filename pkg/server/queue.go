@@ -0,0 +1,103 @@
+package server
+
+import (
+	"container/list"
+
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// priorities lists job priorities in dispatch order.
+var priorities = [...]int{JobHigh, JobNormal, JobLow}
+
+// jobQueue keeps the pending jobs of one function in a FIFO list per priority.
+type jobQueue struct {
+	lists map[int]*list.List
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{lists: make(map[int]*list.List, len(priorities))}
+	for _, p := range priorities {
+		q.lists[p] = list.New()
+	}
+	return q
+}
+
+// listFor returns the list a job of the given priority belongs to. Unknown
+// priorities are queued as normal jobs.
+func (q *jobQueue) listFor(priority int) *list.List {
+	if l, ok := q.lists[priority]; ok {
+		return l
+	}
+	return q.lists[JobNormal]
+}
+
+func (q *jobQueue) PushBack(j *Job) {
+	q.listFor(j.Priority).PushBack(j)
+}
+
+func (q *jobQueue) PushFront(j *Job) {
+	q.listFor(j.Priority).PushFront(j)
+}
+
+// Len returns the number of queued jobs of all priorities.
+func (q *jobQueue) Len() int {
+	n := 0
+	for _, l := range q.lists {
+		n += l.Len()
+	}
+	return n
+}
+
+// LenByPriority returns the number of queued jobs with the given priority.
+func (q *jobQueue) LenByPriority(priority int) int {
+	return q.listFor(priority).Len()
+}
+
+// Each calls f for every queued job in dispatch order until f returns false.
+func (q *jobQueue) Each(f func(j *Job) bool) {
+	for _, p := range priorities {
+		for it := q.lists[p].Front(); it != nil; it = it.Next() {
+			if !f(it.Value.(*Job)) {
+				return
+			}
+		}
+	}
+}
+
+// popPriority removes and returns the first job of the given priority which is
+// not already running.
+func (q *jobQueue) popPriority(priority int) *Job {
+	l := q.listFor(priority)
+	for it := l.Front(); it != nil; it = it.Next() {
+		j := it.Value.(*Job)
+		//Don't return running job. This case arise when server restarted but some job still executing
+		if j.Running {
+			continue
+		}
+		l.Remove(it)
+		return j
+	}
+	return nil
+}
+
+// Remove deletes the job with the given handle from the queue.
+func (q *jobQueue) Remove(j *Job) bool {
+	l := q.listFor(j.Priority)
+	for it := l.Front(); it != nil; it = it.Next() {
+		if it.Value.(*Job).Handle == j.Handle {
+			l.Remove(it)
+			return true
+		}
+	}
+	return false
+}
+
+// hasPending reports whether any queued job is waiting for a worker.
+func (q *jobQueue) hasPending() bool {
+	pending := false
+	q.Each(func(j *Job) bool {
+		pending = !j.Running
+		return !pending
+	})
+	return pending
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/appscode/go/runtime"
 	"github.com/appscode/pat"
+	. "github.com/drawks/gearhulk/pkg/runtime"
 )
 
 func safeHandler(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
@@ -67,6 +69,48 @@ func registerAPIHandlers(s *Server) {
 		}
 	}))
 
+	m.Get("/functions", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		e := &event{tp: ctrlGetFunction, result: createResCh()}
+		s.ctrlEvtCh <- e
+		res := <-e.result
+		switch r := res.(type) {
+		case string:
+			w.Write([]byte(r))
+		}
+	}))
+
+	m.Get("/functions/:function", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		params, _ := pat.FromContext(r.Context())
+		e := &event{tp: ctrlGetFunction, handle: params.Get(":function"), result: createResCh()}
+		s.ctrlEvtCh <- e
+		res := <-e.result
+		switch r := res.(type) {
+		case string:
+			w.Write([]byte(r))
+		}
+	}))
+
+	//set the queue limit of a function, e.g. {"high": 10, "normal": 100, "low": 1000}
+	m.Put("/functions/:function/maxqueue", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		var limit QueueLimit
+		if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit.High < 0 || limit.Normal < 0 || limit.Low < 0 {
+			http.Error(w, "queue limits must not be negative", http.StatusBadRequest)
+			return
+		}
+		params, _ := pat.FromContext(r.Context())
+		e := &event{tp: ctrlMaxQueue, handle: params.Get(":function"), args: &Tuple{t0: limit}, result: createResCh()}
+		s.ctrlEvtCh <- e
+		<-e.result
+	}))
+
 	m.Get("/cronjobs", safeHandler(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -93,5 +137,63 @@ func registerAPIHandlers(s *Server) {
 		}
 	}))
 
+	//a consistent copy of the queued and scheduled jobs, for gearhulk server --restore
+	m.Get("/snapshot", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Snapshot())
+	}))
+
+	//enter drain mode, replies the number of jobs still running
+	m.Post("/drain", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		e := &event{tp: ctrlDrain, result: createResCh()}
+		s.ctrlEvtCh <- e
+		json.NewEncoder(w).Encode(map[string]int{"running": (<-e.result).(int)})
+	}))
+
+	m.Get("/deadletters", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		e := &event{tp: ctrlGetDeadJob, args: &Tuple{t0: r.URL.Query().Get("function")}, result: createResCh()}
+		s.ctrlEvtCh <- e
+		json.NewEncoder(w).Encode(<-e.result)
+	}))
+
+	m.Get("/deadletters/:handle", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		params, _ := pat.FromContext(r.Context())
+		e := &event{tp: ctrlGetDeadJob, handle: params.Get(":handle"), result: createResCh()}
+		s.ctrlEvtCh <- e
+		if deadJobs := (<-e.result).([]*DeadJob); len(deadJobs) > 0 {
+			json.NewEncoder(w).Encode(deadJobs[0])
+		}
+	}))
+
+	m.Post("/deadletters/:handle/requeue", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		params, _ := pat.FromContext(r.Context())
+		e := &event{tp: ctrlRequeueDeadJob, handle: params.Get(":handle"), result: createResCh()}
+		s.ctrlEvtCh <- e
+		if err, ok := (<-e.result).(error); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	}))
+
+	m.Del("/deadletters", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		e := &event{tp: ctrlPurgeDeadJob, result: createResCh()}
+		s.ctrlEvtCh <- e
+		<-e.result
+	}))
+
+	m.Del("/deadletters/:handle", safeHandler(func(w http.ResponseWriter, r *http.Request) {
+		params, _ := pat.FromContext(r.Context())
+		e := &event{tp: ctrlPurgeDeadJob, handle: params.Get(":handle"), result: createResCh()}
+		s.ctrlEvtCh <- e
+		if err, ok := (<-e.result).(error); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	}))
+
 	http.Handle("/", m)
 }
@@ -1,13 +1,14 @@
 package server
 
 import (
-	"bytes"
 	"container/list"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,18 +19,36 @@ import (
 	"github.com/drawks/gearhulk/pkg/metrics"
 	. "github.com/drawks/gearhulk/pkg/runtime"
 	"github.com/drawks/gearhulk/pkg/storage"
-	leveldbq "github.com/drawks/gearhulk/pkg/storage/leveldb"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	lberror "github.com/syndtr/goleveldb/leveldb/errors"
 	"gopkg.in/robfig/cron.v2"
 )
 
 // Config holds the configuration for the Gearman server.
 type Config struct {
 	ListenAddr string // Address to listen on for Gearman protocol connections
-	Storage    string // Directory path for LevelDB storage
+	Storage    string // Storage URI, a plain path is a LevelDB directory
 	WebAddress string // Address for HTTP API and web interface
+
+	Durability    storage.Durability // When job changes reach the disk, batched by default
+	FlushInterval time.Duration      // How long changes wait for the next group commit
+
+	Restore string // Snapshot file restored at start, after loading the storage
+
+	RejectUnknownFunctions bool // Reject submissions for functions no worker registered and no config names
+
+	MaxPacketSize       int           // Largest packet data accepted, DefaultMaxPacketSize when 0
+	ReadTimeout         time.Duration // How long the rest of a started request may take, 0 for no limit
+	IdleTimeout         time.Duration // Connections without a request for this long are closed, 0 for no limit
+	MaxConnections      int           // Limit of open connections, 0 for none
+	MaxConnectionsPerIP int           // Limit of open connections per remote IP, 0 for none
+
+	TLSCertFile     string // Certificate of the Gearman port and the HTTP API, plain TCP and HTTP when empty
+	TLSKeyFile      string // Private key of TLSCertFile
+	TLSClientCAFile string // CAs client certificates must be signed by, not required when empty
+
+	FunctionDefaults FunctionConfig            // Settings for functions without an entry in Functions
+	Functions        map[string]FunctionConfig // Per-function settings, overriding FunctionDefaults
 }
 
 // Server represents a Gearman server instance.
@@ -41,6 +60,14 @@ type Server struct {
 	worker         map[int64]*Worker
 	client         map[int64]*Client
 	jobs           map[string]*Job
+	uniqueJobs     map[string]*Job             //(function, unique id) -> job, for coalescing
+	jobClients     map[string][]int64          //job handle -> sessionIds of waiting clients
+	outcomes       map[string]map[string]int64 //function -> job outcome -> count
+	deadJobs       map[string]*DeadJob         //job handle -> dead-lettered background job
+	maxQueue       map[string]QueueLimit       //function -> limit set with the admin maxqueue command
+	timeouts       *deadlineQueue              //deadlines of the running jobs
+	conns          *connLimiter                //open connections, shared with the sessions
+	certs          *certReloader               //nil without TLS
 	startSessionId int64
 	opCounter      map[PT]int64
 	store          storage.Db
@@ -48,6 +75,11 @@ type Server struct {
 	cronSvc        *cron.Cron
 	cronJobs       map[string]*CronJob
 	mu             *sync.RWMutex
+	draining       bool          //no jobs are handed out or accepted, see Drain
+	closing        chan struct{} //closed when Shutdown starts
+	stopped        chan struct{} //closed when Shutdown finished
+	shutdownOnce   sync.Once
+	shutdownErr    error
 }
 
 var ( //const replys, to avoid building it every time
@@ -70,19 +102,35 @@ func NewServer(cfg Config) *Server {
 		worker:     make(map[int64]*Worker),
 		client:     make(map[int64]*Client),
 		jobs:       make(map[string]*Job),
+		uniqueJobs: make(map[string]*Job),
+		jobClients: make(map[string][]int64),
+		outcomes:   make(map[string]map[string]int64),
+		deadJobs:   make(map[string]*DeadJob),
+		maxQueue:   make(map[string]QueueLimit),
+		timeouts:   newDeadlineQueue(),
+		conns:      newConnLimiter(cfg.MaxConnections, cfg.MaxConnectionsPerIP),
 		opCounter:  make(map[PT]int64),
 		cronSvc:    cron.New(),
 		cronJobs:   make(map[string]*CronJob),
 		mu:         &sync.RWMutex{},
+		closing:    make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 
-	// Initiate data storage
+	// Initiate data storage, a server losing its jobs on restart is no use
 	if len(cfg.Storage) > 0 {
-		s, err := leveldbq.New(cfg.Storage)
+		s, err := storage.Open(cfg.Storage)
 		if err != nil {
-			log.Info(err)
+			log.Fatal(err)
 		}
-		srv.store = s
+		//the event loop must not wait for the disk
+		srv.store = storage.NewBatched(s, storage.BatchOptions{
+			Durability:    cfg.Durability,
+			FlushInterval: cfg.FlushInterval,
+			ErrorHandler: func(err error) {
+				log.Errorln("writing to storage, retrying:", err)
+			},
+		})
 	}
 	return srv
 }
@@ -96,6 +144,10 @@ func (s *Server) loadAllJobs() {
 		log.Error(err)
 		return
 	}
+	//restore submission order, storage returns jobs ordered by handle
+	sort.SliceStable(jobs, func(a, b int) bool {
+		return jobs[a].(*Job).CreateAt.Before(jobs[b].(*Job).CreateAt)
+	})
 	for _, jb := range jobs {
 		j, ok := jb.(*Job)
 		if !ok {
@@ -104,6 +156,9 @@ func (s *Server) loadAllJobs() {
 		}
 		j.ProcessBy = 0 //no body handle it now
 		j.CreateBy = 0  //clear
+		//left running by a crash, its worker can't report to this server
+		j.Running = false
+		j.Deadline = time.Time{}
 		log.Debugf("handle: %v\tfunc: %v\tis_background: %v", j.Handle, j.FuncName, j.IsBackGround)
 		s.doAddJob(j)
 	}
@@ -136,14 +191,27 @@ func (s *Server) loadAllCronJobs() {
 }
 
 // Start starts the Gearman server.
-// This method will block and run the server until it's stopped.
+// This method will block and run the server until Shutdown finished.
 func (s *Server) Start() {
-	ln, err := net.Listen("tcp", s.config.ListenAddr)
+	if len(s.config.TLSCertFile) > 0 {
+		certs, err := newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile, s.config.TLSClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.certs = certs
+	}
+	ln, err := s.listen()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Debug("listening on", s.config.ListenAddr)
+	//load background jobs from storage, before the event loop owns the state
+	if s.store != nil {
+		s.loadAllJobs()
+		s.loadAllCronJobs()
+		s.loadAllDeadJobs()
+	}
 	go s.EvtLoop()
 
 	// Run REST API Server
@@ -154,33 +222,156 @@ func (s *Server) Start() {
 
 			registerAPIHandlers(s)
 
+			web := &http.Server{Addr: s.config.WebAddress}
+			go func() {
+				<-s.stopped
+				web.Close()
+			}()
 			log.Infoln("Running web api at", s.config.WebAddress)
-			log.Fatalln(http.ListenAndServe(s.config.WebAddress, nil))
+			var err error
+			if s.certs != nil {
+				web.TLSConfig = s.certs.tlsConfig("h2", "http/1.1")
+				err = web.ListenAndServeTLS("", "")
+			} else {
+				err = web.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
 		}()
 	}
 
 	go s.WatcherLoop()
-	go s.WatchJobTimeout()
 	if s.cronSvc != nil {
 		s.cronSvc.Start()
 	}
-	//load background jobs from storage
-	if s.store != nil {
-		s.loadAllJobs()
-		s.loadAllCronJobs()
+	go func() {
+		<-s.closing
+		ln.Close()
+		if s.cronSvc != nil {
+			s.cronSvc.Stop()
+		}
+	}()
+	if len(s.config.Restore) > 0 {
+		if err := s.RestoreFile(s.config.Restore); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil { // handle error
+			select {
+			case <-s.closing:
+				<-s.stopped
+				return
+			default:
+			}
 			continue
 		}
 
-		session := &session{}
-		go session.handleConnection(s, conn)
+		go s.serveConn(conn)
 	}
 }
 
+// serveConn runs the session of an accepted connection, unless it exceeds
+// the connection limits.
+func (s *Server) serveConn(conn net.Conn) {
+	ip := remoteIP(conn)
+	if err := s.conns.acquire(ip); err != nil {
+		refuseConnection(conn, err)
+		return
+	}
+	defer s.conns.release(ip)
+	session := &session{}
+	session.handleConnection(s, conn)
+}
+
+// Shutdown stops the server gracefully. It stops accepting connections,
+// drains the server until the running jobs finished or ctx is done, then
+// persists the queued jobs and closes the storage. Start returns once
+// Shutdown finished.
+//
+// Shutdown always drains, a job handed out while the queues are persisted
+// would be stored as queued and run a second time after the restart. Pass
+// a done ctx to stop without waiting for the running jobs, they are stored
+// as queued.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		log.Infoln("shutting down")
+		close(s.closing)
+		s.Drain(ctx)
+		e := &event{tp: ctrlShutdown, result: createResCh()}
+		s.ctrlEvtCh <- e
+		s.shutdownErr, _ = (<-e.result).(error)
+		close(s.stopped)
+		log.Infoln("shutdown finished")
+	})
+	<-s.stopped
+	return s.shutdownErr
+}
+
+// Drain puts the server in drain mode, e.g. before it is stopped or moved to
+// another node. It keeps serving its connections but hands out no jobs and
+// rejects submissions, running jobs may still report back. Drain waits until
+// no job is running and returns ctx.Err() if ctx is done first. The server
+// stays in drain mode until it is shut down.
+func (s *Server) Drain(ctx context.Context) error {
+	for {
+		e := &event{tp: ctrlDrain, result: createResCh()}
+		s.ctrlEvtCh <- e
+		running := (<-e.result).(int)
+		if running == 0 {
+			return nil
+		}
+		log.Infof("waiting for %v running jobs", running)
+		select {
+		case <-ctx.Done():
+			log.Warningf("%v jobs still running: %v", running, ctx.Err())
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// handleDrain enters drain mode and replies the number of running jobs.
+func (s *Server) handleDrain(e *event) {
+	if !s.draining {
+		log.Infoln("draining, no jobs are handed out or accepted")
+	}
+	s.draining = true
+	running := 0
+	for _, j := range s.jobs {
+		if j.Running {
+			running++
+		}
+	}
+	e.result <- running
+}
+
+// handleShutdown persists all jobs and closes the storage. Running jobs are
+// stored as queued, their workers can't report back to a restarted server.
+func (s *Server) handleShutdown(e *event) {
+	if s.store == nil {
+		e.result <- nil
+		return
+	}
+	for _, j := range s.jobs {
+		if j.Running {
+			j.Running = false
+			j.Deadline = time.Time{}
+			j.ProcessBy = 0
+		}
+		s.saveJobInDB(j)
+	}
+	err := s.store.Close()
+	if err != nil {
+		log.Error(err)
+	}
+	s.store = nil
+	e.result <- err
+}
+
 func (s *Server) addWorker(l *list.List, w *Worker) {
 	for it := l.Front(); it != nil; it = it.Next() {
 		if it.Value.(*Worker).SessionId == w.SessionId {
@@ -209,7 +400,7 @@ func (s *Server) removeWorkerBySessionId(sessionId int64) {
 }
 
 func (s *Server) handleCanDo(funcName string, w *Worker) {
-	s.handleCanDoTimeout(funcName, w, DefaultTimeout)
+	s.handleCanDoTimeout(funcName, w, 0)
 }
 
 func (s *Server) handleCanDoTimeout(funcName string, w *Worker, timeout int32) {
@@ -219,10 +410,23 @@ func (s *Server) handleCanDoTimeout(funcName string, w *Worker, timeout int32) {
 	s.worker[w.SessionId] = w
 }
 
+// handleResetAbilities forgets every function of the worker. Its running
+// jobs stay assigned, it may still report them.
+func (s *Server) handleResetAbilities(w *Worker) {
+	for funcName := range w.canDo {
+		if jw, ok := s.funcWorker[funcName]; ok {
+			s.removeWorker(jw.workers, w.SessionId)
+		}
+	}
+	w.canDo = make(map[string]int32)
+	w.lastFunc = ""
+	s.worker[w.SessionId] = w
+}
+
 func (s *Server) getJobWorkPair(funcName string) *jobworkermap {
 	jw, ok := s.funcWorker[funcName]
 	if !ok { //create list
-		jw = &jobworkermap{workers: list.New(), jobs: list.New()}
+		jw = &jobworkermap{workers: list.New(), jobs: newJobQueue()}
 		s.funcWorker[funcName] = jw
 	}
 
@@ -235,61 +439,85 @@ func (s *Server) add2JobWorkerQueue(j *Job) {
 }
 
 func (s *Server) doAddJob(j *Job) {
+	s.queueJob(j)
+	s.saveJobInDB(j)
+}
+
+// queueJob hands a job to the workers, without persisting it.
+func (s *Server) queueJob(j *Job) {
 	j.ProcessBy = 0 //nobody handle it right now
 	s.add2JobWorkerQueue(j)
 	s.jobs[j.Handle] = j
+	if len(j.Id) > 0 {
+		key := uniqueKey(j.FuncName, j.Id)
+		if _, ok := s.uniqueJobs[key]; !ok {
+			s.uniqueJobs[key] = j
+		}
+	}
 	s.wakeupWorker(j.FuncName)
 	if cron, ok := s.getCronJobFromMap(j.CronHandle); ok {
 		cron.Created++
 		s.addCronJob(cron)
 	}
-	s.saveJobInDB(j)
 }
 
-func (s *Server) doAddCronJob(sj *CronJob) {
+func (s *Server) doAddCronJob(sj *CronJob) error {
 	if _, ok := s.getCronJobFromMap(sj.Handle); ok {
 		log.Infoln("cronjob already exists with handle ", sj.Handle)
-		return
+		return nil
 	}
 	scdT, err := NewCronSchedule(sj.Expression)
 	if err != nil {
 		log.Errorln(err)
-		return
+		return nil
 	}
 	sj.CronEntryID = int(s.cronSvc.Schedule(
 		scdT.Schedule(),
 		cron.FuncJob(
 			func() {
-				jb := &Job{
-					Handle:       allocJobId(),
-					Id:           sj.JobTemplete.Id,
-					Data:         sj.JobTemplete.Data,
-					CreateAt:     time.Now(),
-					CreateBy:     sj.JobTemplete.CreateBy,
-					FuncName:     sj.JobTemplete.FuncName,
-					Priority:     sj.JobTemplete.Priority,
-					IsBackGround: sj.JobTemplete.IsBackGround,
-					CronHandle:   sj.Handle,
-				}
-				sj.Next = scdT.Schedule().Next(time.Now())
-				sj.Prev = time.Now()
-				//Update cronJob with new Next and Prev time
-				s.addCronJob(sj)
-				s.doAddJob(jb)
+				//runs on the cron goroutine, the event loop adds the job
+				s.ctrlEvtCh <- &event{tp: ctrlRunCronJob, args: &Tuple{t0: sj, t1: scdT}}
 			})))
 	sj.Next = scdT.Schedule().Next(time.Now())
+	return s.addCronJob(sj)
+}
+
+// handleRunCronJob adds the job of a cron job whose schedule fired.
+func (s *Server) handleRunCronJob(e *event) {
+	sj := e.args.t0.(*CronJob)
+	scdT := e.args.t1.(CronSpecInterface)
+	if _, ok := s.getCronJobFromMap(sj.Handle); !ok {
+		log.Debugf("cronjob %v was cancelled", sj.Handle)
+		return
+	}
+	jb := &Job{
+		Handle:       allocJobId(),
+		Id:           sj.JobTemplete.Id,
+		Data:         sj.JobTemplete.Data,
+		CreateAt:     time.Now(),
+		CreateBy:     sj.JobTemplete.CreateBy,
+		FuncName:     sj.JobTemplete.FuncName,
+		Priority:     sj.JobTemplete.Priority,
+		IsBackGround: sj.JobTemplete.IsBackGround,
+		CronHandle:   sj.Handle,
+	}
+	jb.Transient = !s.persistent(jb, nil)
+	sj.Next = scdT.Schedule().Next(time.Now())
+	sj.Prev = time.Now()
+	//Update cronJob with new Next and Prev time
 	s.addCronJob(sj)
+	s.doAddJob(jb)
 }
 
-func (s *Server) doAddEpochJob(cj *CronJob) {
+func (s *Server) doAddEpochJob(cj *CronJob) error {
 	if _, ok := s.getCronJobFromMap(cj.Handle); ok {
 		log.Infoln("epochjob already exists with handle ", cj.Handle)
-		return
+		return nil
 	}
 	epoch, ok := s.ExpressionToEpoch(cj.Expression)
 	if !ok {
 		log.Errorln("invalid epoch job expression, ", cj.Expression)
-		return
+		return nil
 	}
 	j := &Job{
 		Handle:       allocJobId(),
@@ -301,33 +529,51 @@ func (s *Server) doAddEpochJob(cj *CronJob) {
 		Priority:     cj.JobTemplete.Priority,
 		IsBackGround: cj.JobTemplete.IsBackGround,
 	}
+	j.Transient = !s.persistent(j, nil)
 	after := epoch - time.Now().UTC().Unix()
 	if after < 0 {
 		after = 0
 	}
 	time.AfterFunc(time.Second*time.Duration(after), func() {
-		s.doAddJob(j)
-		err := s.removeCronJob(cj)
-		if err != nil {
-			log.Errorln(err)
-		}
+		s.ctrlEvtCh <- &event{tp: ctrlRunEpochJob, args: &Tuple{t0: j, t1: cj}}
 	})
 	cj.Next = time.Unix(epoch, 0)
-	s.addCronJob(cj)
+	return s.addCronJob(cj)
+}
 
+// handleRunEpochJob adds the job of an epoch job whose time came and
+// forgets the epoch job.
+func (s *Server) handleRunEpochJob(e *event) {
+	j := e.args.t0.(*Job)
+	cj := e.args.t1.(*CronJob)
+	if _, ok := s.getCronJobFromMap(cj.Handle); !ok {
+		log.Debugf("epochjob %v was cancelled", cj.Handle)
+		return
+	}
+	s.doAddJob(j)
+	err := s.removeCronJob(cj)
+	if err != nil {
+		log.Errorln(err)
+	}
 }
 
+// popJob hands out the next job for the worker. Higher priority jobs of any
+// function the worker can do are preferred; among functions with jobs of the
+// same priority the worker is served round-robin, in function name order.
 func (s *Server) popJob(sessionId int64) (j *Job) {
-	for funcName := range s.worker[sessionId].canDo {
-		if wj, ok := s.funcWorker[funcName]; ok {
-			for it := wj.jobs.Front(); it != nil; it = it.Next() {
-				jtmp := it.Value.(*Job)
-				//Don't return running job. This case arise when server restarted but some job still executing
-				if jtmp.Running {
-					continue
-				}
-				j = jtmp
-				wj.jobs.Remove(it)
+	if s.draining {
+		return nil
+	}
+	w := s.worker[sessionId]
+	funcs := w.canDoFrom(w.lastFunc)
+	for _, p := range priorities {
+		for _, funcName := range funcs {
+			wj, ok := s.funcWorker[funcName]
+			if !ok {
+				continue
+			}
+			if j = wj.jobs.popPriority(p); j != nil {
+				w.lastFunc = funcName
 				return
 			}
 		}
@@ -337,19 +583,11 @@ func (s *Server) popJob(sessionId int64) (j *Job) {
 
 func (s *Server) wakeupWorker(funcName string) bool {
 	wj, ok := s.funcWorker[funcName]
-	if !ok || wj.jobs.Len() == 0 || wj.workers.Len() == 0 {
+	if !ok || s.draining || wj.jobs.Len() == 0 || wj.workers.Len() == 0 {
 		return false
 	}
 	//Don't wakeup for running job
-	var allRunning = true
-	for it := wj.jobs.Front(); it != nil; it = it.Next() {
-		j := it.Value.(*Job)
-		if !j.Running {
-			allRunning = false
-			break
-		}
-	}
-	if allRunning {
+	if !wj.jobs.hasPending() {
 		return false
 	}
 	for it := wj.workers.Front(); it != nil; it = it.Next() {
@@ -360,6 +598,8 @@ func (s *Server) wakeupWorker(funcName string) bool {
 
 		log.Debug("wakeup sessionId ", w.SessionId)
 
+		w.asleep = false
+		w.setBusy()
 		w.Send(wakeupReply)
 		return true
 	}
@@ -367,15 +607,101 @@ func (s *Server) wakeupWorker(funcName string) bool {
 	return false
 }
 
-func (s *Server) removeJob(j *Job, isSuccess bool) {
+// findUniqueJob returns the pending or running job submitted for funcName
+// with the given unique id.
+func (s *Server) findUniqueJob(funcName, unique string) (*Job, bool) {
+	if len(unique) == 0 {
+		return nil, false
+	}
+	j, ok := s.uniqueJobs[uniqueKey(funcName, unique)]
+	return j, ok
+}
+
+// findJobByUnique returns a job with the given unique id, regardless of its
+// function, as GET_STATUS_UNIQUE does not carry a function name.
+func (s *Server) findJobByUnique(unique string) (*Job, bool) {
+	if len(unique) == 0 {
+		return nil, false
+	}
+	for _, j := range s.uniqueJobs {
+		if j.Id == unique {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// attachClient registers a client session to receive the work reports of a job.
+func (s *Server) attachClient(j *Job, sessionId int64) {
+	for _, id := range s.jobClients[j.Handle] {
+		if id == sessionId {
+			return
+		}
+	}
+	s.jobClients[j.Handle] = append(s.jobClients[j.Handle], sessionId)
+	if c, ok := s.client[sessionId]; ok {
+		atomic.AddInt32(&c.waiting, 1)
+	}
+}
+
+// sendToJobClients forwards a reply to every client waiting for the job.
+func (s *Server) sendToJobClients(j *Job, reply []byte) {
+	for _, sessionId := range s.jobClients[j.Handle] {
+		c, ok := s.client[sessionId]
+		if !ok {
+			log.Debug(j.Handle, "sessionId", sessionId, "missing")
+			continue
+		}
+		c.Send(reply)
+		s.forwardReport++
+	}
+}
+
+// sendExceptionToJobClients forwards a WORK_EXCEPTION to the clients waiting
+// for the job which set the exceptions option, as gearmand does. The others
+// get a WORK_FAIL, the job ends either way.
+func (s *Server) sendExceptionToJobClients(j *Job, reply []byte) {
+	fail := constructReply(PT_WorkFail, [][]byte{[]byte(j.Handle)})
+	for _, sessionId := range s.jobClients[j.Handle] {
+		c, ok := s.client[sessionId]
+		if !ok {
+			log.Debug(j.Handle, "sessionId", sessionId, "missing")
+			continue
+		}
+		if c.exceptions {
+			c.Send(reply)
+		} else {
+			c.Send(fail)
+		}
+		s.forwardReport++
+	}
+}
+
+func (s *Server) removeJob(j *Job, outcome string) {
 	delete(s.jobs, j.Handle)
+	for _, sessionId := range s.jobClients[j.Handle] {
+		if c, ok := s.client[sessionId]; ok {
+			atomic.StoreInt64(&c.doneAt, time.Now().UnixNano())
+			atomic.AddInt32(&c.waiting, -1)
+		}
+	}
+	delete(s.jobClients, j.Handle)
+	if len(j.Id) > 0 {
+		key := uniqueKey(j.FuncName, j.Id)
+		if uj, ok := s.uniqueJobs[key]; ok && uj == j {
+			delete(s.uniqueJobs, key)
+		}
+	}
 	if pw, found := s.worker[j.ProcessBy]; found {
 		delete(pw.runningJobs, j.Handle)
+		pw.setBusy()
 	}
-	log.Debugf("job removed: %v", j.Handle)
+	s.timeouts.remove(j.Handle)
+	s.countOutcome(j.FuncName, outcome)
+	log.Debugf("job removed: %v %v", j.Handle, outcome)
 	if j.IsBackGround {
 		if cron, ok := s.getCronJobFromMap(j.CronHandle); ok {
-			if isSuccess {
+			if outcome == outcomeCompleted {
 				cron.SuccessfulRun++
 			} else {
 				cron.FailedRun++
@@ -383,7 +709,7 @@ func (s *Server) removeJob(j *Job, isSuccess bool) {
 			s.addCronJob(cron)
 		}
 	}
-	if s.store == nil {
+	if s.store == nil || j.Transient {
 		return
 	}
 	if err := s.store.Delete(j); err != nil {
@@ -391,17 +717,81 @@ func (s *Server) removeJob(j *Job, isSuccess bool) {
 	}
 }
 
+func (s *Server) countOutcome(funcName, outcome string) {
+	counts, ok := s.outcomes[funcName]
+	if !ok {
+		counts = make(map[string]int64)
+		s.outcomes[funcName] = counts
+	}
+	counts[outcome]++
+}
+
 func (s *Server) jobDone(j *Job) {
-	s.removeJob(j, true)
+	s.removeJob(j, outcomeCompleted)
 }
 
-func (s *Server) jobFailed(j *Job) {
-	s.removeJob(j, false)
+func (s *Server) jobFailed(j *Job, cause string) {
+	outcome := outcomeFailed
+	if s.functionConfig(j.FuncName).Retry.Enabled() {
+		outcome = outcomeExhausted
+	}
+	s.removeJob(j, outcome)
+	s.deadLetter(j, outcome, cause)
 }
 
 func (s *Server) jobFailedWithException(j *Job, cause string) {
 	log.Warningf("Job failed with cause `%v`", cause)
-	s.removeJob(j, false)
+	s.removeJob(j, outcomeException)
+	s.deadLetter(j, outcomeException, cause)
+}
+
+// retryJob schedules another attempt of a failed running job and reports
+// whether the retry policy of its function allowed it. The job stays known
+// to the server while it waits for the backoff delay.
+func (s *Server) retryJob(j *Job) bool {
+	policy := s.functionConfig(j.FuncName).Retry
+	if !policy.Enabled() || j.Attempts >= policy.MaxAttempts {
+		return false
+	}
+	if pw, found := s.worker[j.ProcessBy]; found {
+		delete(pw.runningJobs, j.Handle)
+		pw.setBusy()
+	}
+	s.timeouts.remove(j.Handle)
+	j.Running = false
+	j.Deadline = time.Time{}
+	j.ProcessBy = 0
+	j.Percent, j.Denominator = 0, 0
+	s.countOutcome(j.FuncName, outcomeRetried)
+	s.saveJobInDB(j)
+
+	delay := policy.Delay(j.Attempts)
+	log.Infof("job %v failed after %v attempts, retry in %v", j.Handle, j.Attempts, delay)
+	if delay <= 0 {
+		s.requeueJob(j)
+		return true
+	}
+	handle := j.Handle
+	time.AfterFunc(delay, func() {
+		s.ctrlEvtCh <- &event{tp: ctrlRequeueJob, handle: handle}
+	})
+	return true
+}
+
+// requeueJob puts a known job which is not running back into its queue.
+func (s *Server) requeueJob(j *Job) {
+	s.add2JobWorkerQueue(j)
+	s.wakeupWorker(j.FuncName)
+	s.saveJobInDB(j)
+}
+
+func (s *Server) handleRequeueJob(e *event) {
+	j, ok := s.jobs[e.handle]
+	if !ok || j.Running {
+		log.Debugf("job %v no longer waits for a retry", e.handle)
+		return
+	}
+	s.requeueJob(j)
 }
 
 func (s *Server) handleCloseSession(e *event) error {
@@ -424,10 +814,46 @@ func (s *Server) handleCloseSessionForWorker(sessionId int64) {
 			log.Fatalf("sessionId not match %d-%d, bug found", sessionId, w.SessionId)
 		}
 		s.removeWorkerBySessionId(w.SessionId)
+		s.requeueRunningJobs(w)
 		log.Debugf("worker with sessionId: %v unregistered.", sessionId)
 	}
 }
 
+// requeueRunningJobs returns the jobs of a gone worker to the front of their
+// queues, in the order they were handed out. Jobs which used up the attempts
+// of their retry policy fail instead.
+func (s *Server) requeueRunningJobs(w *Worker) {
+	jobs := make([]*Job, 0, len(w.runningJobs))
+	for _, j := range w.runningJobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ProcessAt.After(jobs[b].ProcessAt) })
+	requeued := make(map[string]bool)
+	for _, j := range jobs {
+		delete(w.runningJobs, j.Handle)
+		s.timeouts.remove(j.Handle)
+		if policy := s.functionConfig(j.FuncName).Retry; policy.Enabled() && j.Attempts >= policy.MaxAttempts {
+			log.Infof("job %v lost its worker after %v attempts", j.Handle, j.Attempts)
+			s.sendToJobClients(j, constructReply(PT_WorkFail, [][]byte{[]byte(j.Handle)}))
+			s.jobFailed(j, "worker disconnected")
+			continue
+		}
+		j.Running = false
+		j.Deadline = time.Time{}
+		j.ProcessBy = 0
+		j.Percent, j.Denominator = 0, 0
+		s.getJobWorkPair(j.FuncName).jobs.PushFront(j)
+		s.countOutcome(j.FuncName, outcomeRequeued)
+		s.saveJobInDB(j)
+		requeued[j.FuncName] = true
+		log.Infof("job %v requeued, its worker disconnected", j.Handle)
+	}
+	w.setBusy()
+	for funcName := range requeued {
+		s.wakeupWorker(funcName)
+	}
+}
+
 func (s *Server) handleCloseSessionForClient(sessionId int64) {
 	if c, ok := s.client[sessionId]; ok {
 		log.Debug("removeClient with sessionId ", sessionId)
@@ -504,6 +930,76 @@ func (s *Server) handleGetJob(e *event) (err error) {
 	return
 }
 
+// functionStatus is the REST API view of a function.
+type functionStatus struct {
+	Name     string           `json:"function_name"`
+	High     int              `json:"queued_high"`
+	Normal   int              `json:"queued_normal"`
+	Low      int              `json:"queued_low"`
+	Running  int              `json:"running"`
+	Workers  int              `json:"workers"`
+	MaxQueue QueueLimit       `json:"max_queue"`
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+func (s *Server) functionStatus(funcName string) *functionStatus {
+	fs := &functionStatus{Name: funcName, MaxQueue: s.queueLimit(funcName), Outcomes: make(map[string]int64)}
+	if jw, ok := s.funcWorker[funcName]; ok {
+		fs.High = jw.jobs.LenByPriority(JobHigh)
+		fs.Normal = jw.jobs.LenByPriority(JobNormal)
+		fs.Low = jw.jobs.LenByPriority(JobLow)
+		fs.Workers = jw.workers.Len()
+	}
+	for _, j := range s.jobs {
+		if j.FuncName == funcName && j.Running {
+			fs.Running++
+		}
+	}
+	for outcome, n := range s.outcomes[funcName] {
+		fs.Outcomes[outcome] = n
+	}
+	return fs
+}
+
+func (s *Server) handleGetFunction(e *event) (err error) {
+	log.Debug("get functions ", e.handle)
+	var buf []byte
+	defer func() {
+		e.result <- string(buf)
+	}()
+
+	if len(e.handle) == 0 {
+		names := make(map[string]bool)
+		for funcName := range s.funcWorker {
+			names[funcName] = true
+		}
+		for funcName := range s.outcomes {
+			names[funcName] = true
+		}
+		funcs := make([]*functionStatus, 0, len(names))
+		for funcName := range names {
+			funcs = append(funcs, s.functionStatus(funcName))
+		}
+		sort.Slice(funcs, func(a, b int) bool { return funcs[a].Name < funcs[b].Name })
+		buf, err = json.Marshal(funcs)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		return nil
+	}
+
+	_, known := s.funcWorker[e.handle]
+	if _, counted := s.outcomes[e.handle]; known || counted {
+		buf, err = json.Marshal(s.functionStatus(e.handle))
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	return
+}
+
 func (s *Server) handleGetCronJob(e *event) (err error) {
 	log.Debug("get cronjobs ", e.handle)
 	var buf []byte
@@ -550,6 +1046,50 @@ func (s *Server) handleCtrlEvt(e *event) (err error) {
 		return s.handleGetWorker(e)
 	case ctrlGetCronJob:
 		return s.handleGetCronJob(e)
+	case ctrlGetFunction:
+		return s.handleGetFunction(e)
+	case ctrlRequeueJob:
+		s.handleRequeueJob(e)
+	case ctrlGetDeadJob:
+		s.handleGetDeadJob(e)
+	case ctrlRequeueDeadJob:
+		s.handleRequeueDeadJob(e)
+	case ctrlPurgeDeadJob:
+		s.handlePurgeDeadJob(e)
+	case ctrlDrain:
+		s.handleDrain(e)
+	case ctrlShutdown:
+		s.handleShutdown(e)
+	case ctrlShowJobs:
+		s.handleShowJobs(e)
+	case ctrlShowUniqueJobs:
+		s.handleShowUniqueJobs(e)
+	case ctrlCreateFunction:
+		s.handleCreateFunction(e)
+	case ctrlDropFunction:
+		s.handleDropFunction(e)
+	case ctrlMaxQueue:
+		s.handleMaxQueue(e)
+	case ctrlSnapshot:
+		s.handleSnapshot(e)
+	case ctrlRestore:
+		s.handleRestore(e)
+	case ctrlStats:
+		s.handleStats(e)
+	case ctrlRunCronJob:
+		s.handleRunCronJob(e)
+	case ctrlRunEpochJob:
+		s.handleRunEpochJob(e)
+	case ctrlCancelCronJob:
+		s.handleCancelCronJob(e)
+	case ctrlStatus:
+		s.handleStatus(e)
+	case ctrlPriorityStatus:
+		s.handlePriorityStatus(e)
+	case ctrlWorkers:
+		s.handleWorkers(e)
+	case ctrlLogJobs:
+		s.handleLogJobs(e)
 	default:
 		log.Warningf("%s, %d", e.tp, e.tp)
 	}
@@ -561,27 +1101,73 @@ func (s *Server) handleSubmitJob(e *event) {
 	args := e.args
 	c := args.t0.(*Client)
 	s.client[c.SessionId] = c
+	if s.draining {
+		e.result <- shuttingDown
+		return
+	}
 	funcName := bytes2str(args.t1)
+	unique := bytes2str(args.t2)
+	if j, ok := s.findUniqueJob(funcName, unique); ok {
+		//coalesce with the existing job, a foreground client also gets its results
+		if !isBackGround(e.tp) {
+			s.attachClient(j, c.SessionId)
+		}
+		log.Debugf("coalesced %v with job %v for unique id `%v`", e.tp, j.Handle, unique)
+		e.result <- j.Handle
+		return
+	}
+	if err := s.checkFunction(funcName); err != nil {
+		e.result <- err
+		return
+	}
+	priority := cmd2Priority(e.tp)
+	if s.queueFull(funcName, priority) {
+		log.Warningf("queue of function `%v` is full, %v rejected", funcName, e.tp)
+		s.countOutcome(funcName, outcomeRejected)
+		e.result <- &codedError{code: "QUEUE_ERROR", msg: fmt.Sprintf("queue of function %v is full", funcName)}
+		return
+	}
 	j := &Job{
 		Handle:       allocJobId(),
-		Id:           bytes2str(args.t2),
+		Id:           unique,
 		Data:         args.t3.([]byte),
 		CreateAt:     time.Now(),
 		CreateBy:     c.SessionId,
 		FuncName:     funcName,
-		Priority:     cmd2Priority(e.tp),
+		Priority:     priority,
 		IsBackGround: isBackGround(e.tp),
 	}
+	if reducer, ok := args.t4.([]byte); ok {
+		j.Reducer = string(reducer)
+	}
+	j.Transient = !s.persistent(j, c)
+	j.DeadlineSec = c.timeout
 	//log.Debugf("%v, job handle %v, %s", CmdDescription(e.tp), j.Handle, string(j.Data))
+	//JOB_CREATED only after the job is stored, as the durability promises
+	if err := s.saveJobInDB(j); err != nil {
+		e.result <- storageError(err)
+		return
+	}
+	if !j.IsBackGround {
+		s.attachClient(j, c.SessionId)
+	}
+	s.queueJob(j)
 	e.result <- j.Handle
-	s.doAddJob(j)
 }
 
 func (s *Server) handleSubmitCronJob(e *event) {
 	args := e.args
 	c := args.t0.(*Client)
 	s.client[c.SessionId] = c
+	if s.draining {
+		e.result <- shuttingDown
+		return
+	}
 	funcName := bytes2str(args.t1)
+	if err := s.checkFunction(funcName); err != nil {
+		e.result <- err
+		return
+	}
 	sst, err := NewCronSchedule(fmt.Sprintf("%v %v %v %v %v",
 		byte2strWithFixSpace(args.t3),
 		byte2strWithFixSpace(args.t4),
@@ -591,6 +1177,7 @@ func (s *Server) handleSubmitCronJob(e *event) {
 	)
 	if err != nil {
 		log.Errorln(err)
+		e.result <- &codedError{code: "INVALID_SCHEDULE", msg: err.Error()}
 		return
 	}
 	sj := &CronJob{
@@ -606,9 +1193,13 @@ func (s *Server) handleSubmitCronJob(e *event) {
 		Expression: sst.Expr(),
 	}
 	sj.Handle = allocSchedJobId()
-	e.result <- sj.Handle
 	// persistent Cron Job
-	s.doAddCronJob(sj)
+	if err := s.doAddCronJob(sj); err != nil {
+		s.forgetCronJob(sj)
+		e.result <- storageError(err)
+		return
+	}
+	e.result <- sj.Handle
 	log.Debugf("add cron job with handle: %v func: %v expr: %v", sj.Handle, sj.JobTemplete.FuncName, sj.Expression)
 }
 
@@ -616,11 +1207,20 @@ func (s *Server) handleSubmitEpochJob(e *event) {
 	args := e.args
 	c := args.t0.(*Client)
 	s.client[c.SessionId] = c
+	if s.draining {
+		e.result <- shuttingDown
+		return
+	}
 	funcName := bytes2str(args.t1)
+	if err := s.checkFunction(funcName); err != nil {
+		e.result <- err
+		return
+	}
 	epochStr := bytes2str(args.t3)
 	_, err := strconv.ParseInt(epochStr, 10, 64)
 	if err != nil {
 		log.Errorln(err)
+		e.result <- &codedError{code: "INVALID_SCHEDULE", msg: fmt.Sprintf("invalid epoch %q", epochStr)}
 		return
 	}
 	sj := &CronJob{
@@ -636,10 +1236,13 @@ func (s *Server) handleSubmitEpochJob(e *event) {
 		Expression: EpochTimePrefix + epochStr,
 	}
 	sj.Handle = allocSchedJobId()
-	e.result <- sj.Handle
-
 	// persistent Cron Job
-	s.doAddEpochJob(sj)
+	if err := s.doAddEpochJob(sj); err != nil {
+		s.forgetCronJob(sj)
+		e.result <- storageError(err)
+		return
+	}
+	e.result <- sj.Handle
 	log.Debugf("add epoch job with handle: %v func: %v", sj.Handle, sj.JobTemplete.FuncName)
 }
 
@@ -654,6 +1257,28 @@ func (s *Server) handleWorkReport(e *event) {
 			e.tp, jobhandle, s.jobs)
 		return
 	}
+	//a late report of a worker the job was taken from, after a retry, a
+	//timeout or its disconnect, must not touch the current attempt
+	if j.ProcessBy != e.fromSessionId {
+		log.Warningf("ignoring %v of job %v from worker %v, it is running on %v",
+			e.tp, jobhandle, e.fromSessionId, j.ProcessBy)
+		return
+	}
+
+	//a failed attempt is only reported to the clients once retries are exhausted
+	if e.tp == PT_WorkFail && s.retryJob(j) {
+		return
+	}
+
+	//work reports are forwarded to every client waiting for the job. a
+	//background job only has clients when a foreground submission was
+	//coalesced with it, otherwise it is detached.
+	reply := constructReply(e.tp, slice)
+	if e.tp == PT_WorkException {
+		s.sendExceptionToJobClients(j, reply)
+	} else {
+		s.sendToJobClients(j, reply)
+	}
 
 	switch e.tp {
 	case PT_WorkStatus:
@@ -662,34 +1287,10 @@ func (s *Server) handleWorkReport(e *event) {
 	case PT_WorkException:
 		s.jobFailedWithException(j, string(slice[1]))
 	case PT_WorkFail:
-		s.jobFailed(j)
+		s.jobFailed(j, "")
 	case PT_WorkComplete:
 		s.jobDone(j)
 	}
-
-	//the client is not updated with status or notified when the job has completed (it is detached)
-	if j.IsBackGround {
-		return
-	}
-
-	//broadcast all clients, which is a really bad idea
-	//for _, c := range self.client {
-	//	reply := constructReply(e.tp, slice)
-	//	c.Send(reply)
-	//}
-
-	//just send to original client, which is a bad idea too.
-	//if need work status notification, you should create co-worker.
-	//let worker send status to this co-worker
-	c, ok := s.client[j.CreateBy]
-	if !ok {
-		log.Debug(j.Handle, "sessionId", j.CreateBy, "missing")
-		return
-	}
-
-	reply := constructReply(e.tp, slice)
-	c.Send(reply)
-	s.forwardReport++
 }
 
 func (s *Server) handleProtoEvt(e *event) {
@@ -708,13 +1309,12 @@ func (s *Server) handleProtoEvt(e *event) {
 		funcName := args.t1.(string)
 		s.handleCanDo(funcName, w)
 		log.Debugf("worker with sessionId: %v add function `%v`", w.SessionId, funcName)
-	case PT_CanDoTimeout: //todo: fix timeout support, now just as CAN_DO
+	case PT_CanDoTimeout:
 		w := args.t0.(*Worker)
 		funcName := args.t1.(string)
-		var timeout int32
-		err := binary.Read(bytes.NewReader(args.t2.([]byte)), binary.BigEndian, &timeout)
+		timeout, err := parseCanDoTimeout(args.t2.([]byte))
 		if err != nil {
-			log.Fatal("error when parsing timeout")
+			log.Warningf("worker with sessionId: %v sent an invalid timeout for `%v`: %v", w.SessionId, funcName, err)
 		}
 		s.handleCanDoTimeout(funcName, w, timeout)
 		log.Debugf("worker with sessionId: %v add function `%v` with timeout %v sec", w.SessionId, funcName, timeout)
@@ -726,10 +1326,25 @@ func (s *Server) handleProtoEvt(e *event) {
 		}
 		delete(s.worker[sessionId].canDo, funcName)
 		log.Debugf("worker with sessionId: %v remove function `%v`", sessionId, funcName)
+	case PT_OptionReq:
+		c := args.t0.(*Client)
+		if args.t1.(string) == "exceptions" {
+			c.exceptions = true
+		}
+	case PT_ResetAbilities:
+		w := args.t0.(*Worker)
+		s.handleResetAbilities(w)
+		log.Debugf("worker with sessionId: %v reset its functions", w.SessionId)
+	case PT_AllYours:
+		//gearmand ignores it as well, jobs are still announced with NOOP
+		w := args.t0.(*Worker)
+		w.allYours = true
+		s.worker[w.SessionId] = w
+		log.Debugf("worker with sessionId: %v is connected to this server only", w.SessionId)
 	case PT_SetClientId:
 		w := args.t0.(*Worker)
 		w.workerId = args.t1.(string)
-	case PT_GrabJobUniq:
+	case PT_GrabJob, PT_GrabJobUniq, PT_GrabJobAll:
 		sessionId := e.fromSessionId
 		w, ok := s.worker[sessionId]
 		if !ok {
@@ -737,11 +1352,19 @@ func (s *Server) handleProtoEvt(e *event) {
 			break
 		}
 		w.status = wsRunning
+		w.asleep = false
 		j := s.popJob(sessionId)
 		if j != nil {
 			j.ProcessAt = time.Now()
 			j.ProcessBy = sessionId
-			j.TimeoutSec = w.canDo[j.FuncName]
+			timeout := s.jobTimeout(j, w)
+			j.TimeoutSec = int32(timeout / time.Second)
+			j.Deadline = time.Time{}
+			if timeout > 0 {
+				j.Deadline = j.ProcessAt.Add(timeout)
+				s.timeouts.add(j.Handle, j.Deadline)
+			}
+			j.Attempts++
 			//track this job
 			j.Running = true
 			w.runningJobs[j.Handle] = j
@@ -750,6 +1373,7 @@ func (s *Server) handleProtoEvt(e *event) {
 		} else { //no job
 			w.status = wsPrepareForSleep
 		}
+		w.setBusy()
 		e.result <- j
 
 	case PT_PreSleep:
@@ -762,6 +1386,8 @@ func (s *Server) handleProtoEvt(e *event) {
 			break
 		}
 		w.status = wsSleep
+		w.asleep = true
+		w.setBusy()
 		log.Debugf("worker with sessionId %d sleep", sessionId)
 		//check if there are any jobs for this worker
 		for k := range w.canDo {
@@ -769,7 +1395,8 @@ func (s *Server) handleProtoEvt(e *event) {
 				break
 			}
 		}
-	case PT_SubmitJobLow, PT_SubmitJob, PT_SubmitJobHigh, PT_SubmitJobLowBG, PT_SubmitJobBG, PT_SubmitJobHighBG:
+	case PT_SubmitJobLow, PT_SubmitJob, PT_SubmitJobHigh, PT_SubmitJobLowBG, PT_SubmitJobBG, PT_SubmitJobHighBG,
+		PT_SubmitReduceJob, PT_SubmitReduceJobBackground:
 		s.handleSubmitJob(e)
 	case PT_SubmitJobSched:
 		s.handleSubmitCronJob(e)
@@ -785,6 +1412,16 @@ func (s *Server) handleProtoEvt(e *event) {
 
 		e.result <- &Tuple{t0: args.t0, t1: false, t2: false,
 			t3: 0, t4: 100} //always set Denominator to 100 if no status update
+	case PT_GetStatusUnique:
+		unique := bytes2str(args.t0)
+		if job, ok := s.findJobByUnique(unique); ok {
+			e.result <- &Tuple{t0: args.t0, t1: true, t2: job.Running,
+				t3: job.Percent, t4: job.Denominator, t5: len(s.jobClients[job.Handle])}
+			break
+		}
+
+		e.result <- &Tuple{t0: args.t0, t1: false, t2: false,
+			t3: 0, t4: 100, t5: 0}
 	case PT_WorkData, PT_WorkWarning, PT_WorkStatus, PT_WorkComplete,
 		PT_WorkFail, PT_WorkException:
 		s.handleWorkReport(e)
@@ -808,6 +1445,8 @@ func (s *Server) EvtLoop() {
 			s.handleProtoEvt(e)
 		case e := <-s.ctrlEvtCh:
 			s.handleCtrlEvt(e)
+		case now := <-s.timeouts.C():
+			s.expireJobs(now)
 		}
 	}
 }
@@ -817,74 +1456,82 @@ func (s *Server) WatcherLoop() {
 	for {
 		select {
 		case <-ticker.C:
-			rep := 0
-			one := 0
-
-			s.mu.RLock()
-			cLen := len(s.cronJobs)
-			for _, cj := range s.cronJobs {
-				if _, isOne := s.ExpressionToEpoch(cj.Expression); isOne {
-					one++
-				} else {
-					rep++
-				}
-			}
-			s.mu.RUnlock()
-
-			log.Infof("total cron job: %v #repeated job: %v #onetime job: %v", cLen, rep, one)
-			var b, r int = 0, 0
-			for _, j := range s.jobs {
-				if j.IsBackGround {
-					b++
-				}
-				if j.Running {
-					r++
-				}
-			}
-			log.Infof("total job: %v #background: %v #running: %v", len(s.jobs), b, r)
+			s.ctrlEvtCh <- &event{tp: ctrlLogJobs}
 		}
 	}
 }
 
-func (s *Server) WatchJobTimeout() {
-	for range time.NewTicker(time.Second).C {
-		for _, job := range s.jobs {
-			if !job.Running {
-				continue
-			}
-			if time.Now().Sub(job.ProcessAt) > time.Duration(job.TimeoutSec)*time.Second {
-				log.Infof("job %v failed, cause timeout expired", job.Handle)
-				s.jobFailed(job)
-
-				if job.IsBackGround {
-					continue
-				}
-				c, ok := s.client[job.CreateBy]
-				if !ok {
-					log.Debug(job.Handle, "sessionId", job.CreateBy, "missing")
-					continue
-				}
-				sendTimeoutException(c.in, job.Handle, "timeout expired")
-				s.forwardReport++
-			}
+// handleLogJobs logs how many jobs and cron jobs the server knows about.
+func (s *Server) handleLogJobs(e *event) {
+	rep := 0
+	one := 0
+
+	s.mu.RLock()
+	cLen := len(s.cronJobs)
+	for _, cj := range s.cronJobs {
+		if _, isOne := s.ExpressionToEpoch(cj.Expression); isOne {
+			one++
+		} else {
+			rep++
+		}
+	}
+	s.mu.RUnlock()
 
+	log.Infof("total cron job: %v #repeated job: %v #onetime job: %v", cLen, rep, one)
+	var b, r int = 0, 0
+	for _, j := range s.jobs {
+		if j.IsBackGround {
+			b++
+		}
+		if j.Running {
+			r++
 		}
 	}
+	log.Infof("total job: %v #background: %v #running: %v", len(s.jobs), b, r)
+}
+
+// expireJobs fails or retries the running jobs whose deadline passed.
+func (s *Server) expireJobs(now time.Time) {
+	for _, handle := range s.timeouts.expired(now) {
+		job, ok := s.jobs[handle]
+		if !ok || !job.Running {
+			continue
+		}
+		log.Infof("job %v failed, cause timeout expired", job.Handle)
+		if s.retryJob(job) {
+			continue
+		}
+		s.sendExceptionToJobClients(job, timeoutException(job.Handle, "timeout expired"))
+		s.jobFailed(job, "timeout expired")
+	}
 }
 
 func (s *Server) allocSessionId() int64 {
 	return atomic.AddInt64(&s.startSessionId, 1)
 }
 
+// DeleteCronJob cancels a cron or epoch job by its handle.
 func (s *Server) DeleteCronJob(cj *CronJob) error {
+	e := &event{tp: ctrlCancelCronJob, args: &Tuple{t0: cj}, result: createResCh()}
+	s.ctrlEvtCh <- e
+	err, _ := (<-e.result).(error)
+	return err
+}
+
+func (s *Server) handleCancelCronJob(e *event) {
+	cj := e.args.t0.(*CronJob)
+	if known, ok := s.getCronJobFromMap(cj.Handle); ok {
+		cj = known
+	}
 	err := s.removeCronJob(cj)
 	if err != nil {
 		log.Errorln(err)
-		return err
+		e.result <- err
+		return
 	}
 	s.cronSvc.Remove(cron.EntryID(cj.CronEntryID))
 	log.Debugf("job `%v` successfully cancelled.", cj.Handle)
-	return nil
+	e.result <- nil
 }
 
 func (s *Server) ExpressionToEpoch(scdTime string) (int64, bool) {
@@ -925,7 +1572,7 @@ func (s *Server) isClient(sessionId int64) bool {
 	return false
 }
 
-func (s *Server) addCronJob(cj *CronJob) {
+func (s *Server) addCronJob(cj *CronJob) error {
 	s.mu.Lock()
 	s.cronJobs[cj.Handle] = cj
 	s.mu.Unlock()
@@ -934,17 +1581,41 @@ func (s *Server) addCronJob(cj *CronJob) {
 		err := s.store.Add(cj)
 		if err != nil {
 			log.Error(err)
+			return err
 		}
 	}
+	return nil
 }
 
-func (s *Server) saveJobInDB(j *Job) {
-	if s.store == nil {
-		return
+// forgetCronJob drops a cron job which could not be stored, its timer finds
+// it gone.
+func (s *Server) forgetCronJob(cj *CronJob) {
+	s.mu.Lock()
+	delete(s.cronJobs, cj.Handle)
+	s.mu.Unlock()
+	if cj.CronEntryID != 0 {
+		s.cronSvc.Remove(cron.EntryID(cj.CronEntryID))
+	}
+}
+
+func (s *Server) saveJobInDB(j *Job) error {
+	if s.store == nil || j.Transient {
+		return nil
 	}
 	if err := s.store.Add(j); err != nil {
 		log.Warning(err)
+		return err
 	}
+	return nil
+}
+
+// shuttingDown is the reply to submissions once the server drains, the jobs
+// would neither run nor be stored.
+var shuttingDown = &codedError{code: "SHUTTING_DOWN", msg: "server is draining or shutting down"}
+
+// storageError is the reply to a submission which could not be stored.
+func storageError(err error) *codedError {
+	return &codedError{code: "STORAGE_ERROR", msg: err.Error()}
 }
 
 func (s *Server) removeCronJob(cj *CronJob) error {
@@ -954,7 +1625,7 @@ func (s *Server) removeCronJob(cj *CronJob) error {
 
 	if s.store != nil {
 		err := s.store.Delete(cj)
-		if err == lberror.ErrNotFound {
+		if err == storage.ErrNotFound {
 			log.Errorf("handle `%v` not found", cj.Handle)
 			return fmt.Errorf("handle `%v` not found", cj.Handle)
 		}
@@ -971,3 +1642,16 @@ func (s *Server) getCronJobFromMap(handle string) (cronJob *CronJob, ok bool) {
 	cronJob, ok = s.cronJobs[handle]
 	return
 }
+
+// parseCanDoTimeout reads the timeout of CAN_DO_TIMEOUT. gearmand and its
+// libraries send it as decimal seconds, the gearhulk worker as a 4 byte big
+// endian integer.
+func parseCanDoTimeout(data []byte) (int32, error) {
+	if timeout, err := strconv.ParseInt(string(data), 10, 32); err == nil {
+		return int32(timeout), nil
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("invalid timeout %q", data)
+	}
+	return int32(binary.BigEndian.Uint32(data)), nil
+}
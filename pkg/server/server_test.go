@@ -0,0 +1,1573 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drawks/gearhulk/gearadmin"
+	"github.com/drawks/gearhulk/pkg/metrics"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	"github.com/drawks/gearhulk/pkg/storage"
+	leveldbq "github.com/drawks/gearhulk/pkg/storage/leveldb"
+	"github.com/drawks/gearhulk/pkg/storage/memory"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testConn speaks the binary protocol to a session of an in-process server.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T) *Server {
+	return newTestServerWithConfig(t, Config{})
+}
+
+func newTestServerWithConfig(t *testing.T, cfg Config) *Server {
+	s := NewServer(cfg)
+	go s.EvtLoop()
+	return s
+}
+
+// getFunction fetches the REST API view of a function from the event loop.
+func getFunction(t *testing.T, s *Server, funcName string) *functionStatus {
+	t.Helper()
+	e := &event{tp: ctrlGetFunction, handle: funcName, result: createResCh()}
+	s.ctrlEvtCh <- e
+	fs := &functionStatus{}
+	if err := json.Unmarshal([]byte((<-e.result).(string)), fs); err != nil {
+		t.Fatalf("function %v: %v", funcName, err)
+	}
+	return fs
+}
+
+func dialTestServer(t *testing.T, s *Server) *testConn {
+	srvConn, cliConn := net.Pipe()
+	go (&session{}).handleConnection(s, srvConn)
+	t.Cleanup(func() { cliConn.Close() })
+	return &testConn{t: t, conn: cliConn, r: bufio.NewReader(cliConn)}
+}
+
+// listenTest serves s on a free port, for the clients and workers of the
+// client and worker packages.
+func listenTest(t *testing.T, s *Server) string {
+	t.Helper()
+	s.config.ListenAddr = "127.0.0.1:0"
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialAdmin opens an admin protocol connection to the server.
+func dialAdmin(t *testing.T, s *Server) gearadmin.GearmanAdmin {
+	srvConn, cliConn := net.Pipe()
+	go (&session{}).handleConnection(s, srvConn)
+	t.Cleanup(func() { cliConn.Close() })
+	return gearadmin.NewGearmanAdmin(cliConn)
+}
+
+func (c *testConn) send(tp PT, args ...[]byte) {
+	c.t.Helper()
+	data := bytes.Join(args, []byte{0})
+	buf := &bytes.Buffer{}
+	buf.WriteString(ReqStr)
+	binary.Write(buf, binary.BigEndian, tp.Uint32())
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatalf("send %v: %v", tp, err)
+	}
+}
+
+func (c *testConn) recv() (PT, [][]byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	tp, buf, err := ReadMessage(c.r)
+	if err != nil {
+		c.t.Fatalf("recv: %v", err)
+	}
+	args, ok := decodeArgs(tp, buf)
+	if !ok {
+		c.t.Fatalf("recv: malformed %v", tp)
+	}
+	return tp, args
+}
+
+func (c *testConn) expect(tp PT) [][]byte {
+	c.t.Helper()
+	got, args := c.recv()
+	if got != tp {
+		c.t.Fatalf("expected %v, got %v %q", tp, got, args)
+	}
+	return args
+}
+
+// submit sends a submit packet and returns the created job handle.
+func (c *testConn) submit(tp PT, funcName, unique, data string) string {
+	c.t.Helper()
+	c.send(tp, []byte(funcName), []byte(unique), []byte(data))
+	return string(c.expect(PT_JobCreated)[0])
+}
+
+// grab sends GRAB_JOB_UNIQ and returns the assigned job's arguments, or nil
+// when the server has no job.
+func (c *testConn) grab() [][]byte {
+	c.t.Helper()
+	c.send(PT_GrabJobUniq)
+	tp, args := c.recv()
+	switch tp {
+	case PT_NoJob:
+		return nil
+	case PT_JobAssignUniq:
+		return args
+	}
+	c.t.Fatalf("unexpected reply to grab: %v", tp)
+	return nil
+}
+
+// waitJob grabs until the server assigns a job, ignoring NOOP wakeups.
+func (c *testConn) waitJob() [][]byte {
+	c.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c.send(PT_GrabJobUniq)
+		tp, args := c.recv()
+		for tp == PT_Noop {
+			tp, args = c.recv()
+		}
+		switch tp {
+		case PT_JobAssignUniq:
+			return args
+		case PT_NoJob:
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		c.t.Fatalf("unexpected reply to grab: %v", tp)
+	}
+	c.t.Fatal("no job assigned")
+	return nil
+}
+
+func TestPopJobHonorsPriority(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	low := client.submit(PT_SubmitJobLowBG, "prio", "u1", "low")
+	normal := client.submit(PT_SubmitJobBG, "prio", "u2", "normal")
+	high := client.submit(PT_SubmitJobHighBG, "prio", "u3", "high")
+	normal2 := client.submit(PT_SubmitJob, "prio", "u4", "normal2")
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("prio"))
+	for _, handle := range []string{high, normal, normal2, low} {
+		job := worker.grab()
+		if job == nil {
+			t.Fatalf("expected job %v, got none", handle)
+		}
+		if string(job[0]) != handle {
+			t.Errorf("expected job %v, got %v (%s)", handle, string(job[0]), job[3])
+		}
+	}
+	if job := worker.grab(); job != nil {
+		t.Errorf("expected no job, got %q", job)
+	}
+}
+
+func TestPopJobRoundRobinsFunctions(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	a1 := client.submit(PT_SubmitJobBG, "a", "a1", "")
+	a2 := client.submit(PT_SubmitJobBG, "a", "a2", "")
+	b1 := client.submit(PT_SubmitJobBG, "b", "b1", "")
+	c1 := client.submit(PT_SubmitJobHighBG, "c", "c1", "")
+	b2 := client.submit(PT_SubmitJobBG, "b", "b2", "")
+
+	worker := dialTestServer(t, s)
+	for _, funcName := range []string{"c", "b", "a"} {
+		worker.send(PT_CanDo, []byte(funcName))
+	}
+	for _, handle := range []string{c1, a1, b1, a2, b2} {
+		job := worker.grab()
+		if job == nil {
+			t.Fatalf("expected job %v, got none", handle)
+		}
+		if string(job[0]) != handle {
+			t.Errorf("expected job %v, got %v", handle, string(job[0]))
+		}
+	}
+}
+
+func TestCmd2Priority(t *testing.T) {
+	for tp, priority := range map[PT]int{
+		PT_SubmitJob:       JobNormal,
+		PT_SubmitJobBG:     JobNormal,
+		PT_SubmitJobHigh:   JobHigh,
+		PT_SubmitJobHighBG: JobHigh,
+		PT_SubmitJobLow:    JobLow,
+		PT_SubmitJobLowBG:  JobLow,
+	} {
+		if got := cmd2Priority(tp); got != priority {
+			t.Errorf("%v: expected priority %v, got %v", tp, priority, got)
+		}
+	}
+}
+
+func TestUniqueJobsAreCoalesced(t *testing.T) {
+	s := newTestServer(t)
+	c1 := dialTestServer(t, s)
+	c2 := dialTestServer(t, s)
+	bg := dialTestServer(t, s)
+
+	handle := c1.submit(PT_SubmitJob, "coalesce", "same", "payload")
+	if h := c2.submit(PT_SubmitJobHigh, "coalesce", "same", "payload"); h != handle {
+		t.Errorf("foreground submit not coalesced, expected %v got %v", handle, h)
+	}
+	if h := bg.submit(PT_SubmitJobBG, "coalesce", "same", "payload"); h != handle {
+		t.Errorf("background submit not coalesced, expected %v got %v", handle, h)
+	}
+	if h := bg.submit(PT_SubmitJobBG, "coalesce", "other", "payload"); h == handle {
+		t.Errorf("different unique id coalesced into %v", h)
+	}
+	if h := bg.submit(PT_SubmitJobBG, "other", "same", "payload"); h == handle {
+		t.Errorf("different function coalesced into %v", h)
+	}
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("coalesce"))
+	job := worker.grab()
+	if job == nil || string(job[0]) != handle {
+		t.Fatalf("expected job %v, got %q", handle, job)
+	}
+	worker.send(PT_WorkData, []byte(handle), []byte("partial"))
+	worker.send(PT_WorkComplete, []byte(handle), []byte("result"))
+
+	for _, c := range []*testConn{c1, c2} {
+		if args := c.expect(PT_WorkData); string(args[1]) != "partial" {
+			t.Errorf("unexpected work data %q", args)
+		}
+		if args := c.expect(PT_WorkComplete); string(args[0]) != handle || string(args[1]) != "result" {
+			t.Errorf("unexpected work complete %q", args)
+		}
+	}
+
+	//the unique id is free again once the job is done
+	if h := c1.submit(PT_SubmitJobBG, "coalesce", "same", "payload"); h == handle {
+		t.Errorf("finished job %v reused", h)
+	}
+}
+
+func TestReduceJobAndGrabJobAll(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	client.send(PT_SubmitReduceJobBackground, []byte("map"), []byte("u1"), []byte("count"), []byte{}, []byte("a b c"))
+	handle := string(client.expect(PT_JobCreated)[0])
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("map"))
+	worker.send(PT_GrabJobAll)
+	args := worker.expect(PT_JobAssignAll)
+	for i, want := range []string{handle, "map", "u1", "count", "a b c"} {
+		if string(args[i]) != want {
+			t.Errorf("JOB_ASSIGN_ALL argument %d: expected %q, got %q", i, want, args[i])
+		}
+	}
+	if job := worker.grab(); job != nil {
+		t.Errorf("expected no job, got %q", job)
+	}
+}
+
+func TestGetStatusUnique(t *testing.T) {
+	s := newTestServer(t)
+	c1 := dialTestServer(t, s)
+	c2 := dialTestServer(t, s)
+	handle := c1.submit(PT_SubmitJob, "status", "uniq", "")
+	c2.submit(PT_SubmitJob, "status", "uniq", "")
+
+	c1.send(PT_GetStatusUnique, []byte("uniq"))
+	args := c1.expect(PT_StatusResUnique)
+	for i, want := range []string{"uniq", "1", "0", "0", "0", "2"} {
+		if string(args[i]) != want {
+			t.Errorf("queued STATUS_RES_UNIQUE argument %d: expected %q, got %q", i, want, args[i])
+		}
+	}
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("status"))
+	worker.grab()
+	worker.send(PT_WorkStatus, []byte(handle), []byte("3"), []byte("10"))
+	for _, c := range []*testConn{c1, c2} {
+		c.expect(PT_WorkStatus)
+	}
+	c1.send(PT_GetStatusUnique, []byte("uniq"))
+	args = c1.expect(PT_StatusResUnique)
+	for i, want := range []string{"uniq", "1", "1", "3", "10", "2"} {
+		if string(args[i]) != want {
+			t.Errorf("running STATUS_RES_UNIQUE argument %d: expected %q, got %q", i, want, args[i])
+		}
+	}
+
+	c1.send(PT_GetStatusUnique, []byte("missing"))
+	args = c1.expect(PT_StatusResUnique)
+	if string(args[0]) != "missing" || string(args[1]) != "0" {
+		t.Errorf("unexpected status for unknown unique id %q", args)
+	}
+}
+
+func TestGrabJobVariants(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	legacy := client.submit(PT_SubmitJob, "legacy", "u1", "old")
+	uniq := client.submit(PT_SubmitJob, "legacy", "u2", "new")
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("legacy"))
+
+	worker.send(PT_GrabJob)
+	args := worker.expect(PT_JobAssign)
+	if len(args) != 3 || string(args[0]) != legacy || string(args[1]) != "legacy" || string(args[2]) != "old" {
+		t.Errorf("unexpected JOB_ASSIGN %q", args)
+	}
+	worker.send(PT_GrabJobUniq)
+	args = worker.expect(PT_JobAssignUniq)
+	if len(args) != 4 || string(args[0]) != uniq || string(args[2]) != "u2" || string(args[3]) != "new" {
+		t.Errorf("unexpected JOB_ASSIGN_UNIQ %q", args)
+	}
+	worker.send(PT_GrabJob)
+	worker.expect(PT_NoJob)
+
+	//both jobs are tracked as running by the worker
+	for _, handle := range []string{legacy, uniq} {
+		client.send(PT_GetStatus, []byte(handle))
+		if args := client.expect(PT_StatusRes); string(args[1]) != "1" || string(args[2]) != "1" {
+			t.Errorf("job %v should be known and running, got %q", handle, args)
+		}
+	}
+	worker.send(PT_WorkComplete, []byte(legacy), []byte("done"))
+	if args := client.expect(PT_WorkComplete); string(args[0]) != legacy {
+		t.Errorf("unexpected WORK_COMPLETE %q", args)
+	}
+	worker.send(PT_WorkFail, []byte(uniq))
+	if args := client.expect(PT_WorkFail); string(args[0]) != uniq {
+		t.Errorf("unexpected WORK_FAIL %q", args)
+	}
+	client.send(PT_GetStatus, []byte(legacy))
+	if args := client.expect(PT_StatusRes); string(args[1]) != "0" {
+		t.Errorf("job %v should be gone, got %q", legacy, args)
+	}
+}
+
+func TestRetryFailedJobs(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"flaky": {Retry: RetryPolicy{MaxAttempts: 3}},
+			"slow":  {Retry: RetryPolicy{MaxAttempts: 2, Backoff: 50 * time.Millisecond}},
+		},
+	})
+	client := dialTestServer(t, s)
+	handle := client.submit(PT_SubmitJob, "flaky", "u1", "")
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("flaky"))
+	worker.send(PT_CanDo, []byte("slow"))
+	for attempt := 1; attempt <= 3; attempt++ {
+		job := worker.grab()
+		if job == nil || string(job[0]) != handle {
+			t.Fatalf("attempt %d: expected job %v, got %q", attempt, handle, job)
+		}
+		worker.send(PT_WorkFail, []byte(handle))
+	}
+	//only the exhausted job is reported to the client
+	if args := client.expect(PT_WorkFail); string(args[0]) != handle {
+		t.Errorf("unexpected WORK_FAIL %q", args)
+	}
+	if job := worker.grab(); job != nil {
+		t.Errorf("expected no job, got %q", job)
+	}
+	fs := getFunction(t, s, "flaky")
+	if fs.Outcomes[outcomeRetried] != 2 || fs.Outcomes[outcomeExhausted] != 1 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+
+	//a retry with backoff is queued again once the delay expired
+	handle = client.submit(PT_SubmitJobBG, "slow", "u2", "")
+	if job := worker.grab(); job == nil {
+		t.Fatal("expected a job")
+	}
+	worker.send(PT_WorkFail, []byte(handle))
+	if job := worker.grab(); job != nil {
+		t.Fatalf("retry should wait for the backoff, got %q", job)
+	}
+	time.Sleep(100 * time.Millisecond)
+	job := worker.grab()
+	if job == nil || string(job[0]) != handle {
+		t.Fatalf("expected retried job %v, got %q", handle, job)
+	}
+	worker.send(PT_WorkComplete, []byte(handle), nil)
+	fs = getFunction(t, s, "slow")
+	if fs.Outcomes[outcomeRetried] != 1 || fs.Outcomes[outcomeCompleted] != 1 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+}
+
+func TestStaleWorkReports(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"flaky": {Retry: RetryPolicy{MaxAttempts: 3}},
+		},
+	})
+	client := dialTestServer(t, s)
+	handle := client.submit(PT_SubmitJob, "flaky", "u1", "")
+
+	first := dialTestServer(t, s)
+	first.send(PT_CanDo, []byte("flaky"))
+	if job := first.grab(); job == nil {
+		t.Fatal("expected a job")
+	}
+	first.send(PT_WorkFail, []byte(handle))
+	second := dialTestServer(t, s)
+	second.send(PT_CanDo, []byte("flaky"))
+	if job := second.grab(); job == nil || string(job[0]) != handle {
+		t.Fatalf("expected retried job %v, got %q", handle, job)
+	}
+
+	//the first worker reports again, for the attempt it lost
+	first.send(PT_WorkData, []byte(handle), []byte("stale"))
+	first.send(PT_WorkFail, []byte(handle))
+	first.send(PT_WorkComplete, []byte(handle), []byte("stale"))
+	//answered by the event loop after the reports
+	if job := first.grab(); job != nil {
+		t.Fatalf("expected no job, got %q", job)
+	}
+	j := getJob(t, s, handle)
+	if !j.Running || j.Attempts != 2 {
+		t.Errorf("current attempt disturbed: running %v, attempts %v", j.Running, j.Attempts)
+	}
+
+	second.send(PT_WorkComplete, []byte(handle), []byte("done"))
+	if args := client.expect(PT_WorkComplete); string(args[1]) != "done" {
+		t.Errorf("unexpected WORK_COMPLETE %q", args)
+	}
+	fs := getFunction(t, s, "flaky")
+	if fs.Outcomes[outcomeRetried] != 1 || fs.Outcomes[outcomeCompleted] != 1 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempts, want := range map[int]time.Duration{
+		1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 60: 5 * time.Second,
+	} {
+		if got := p.Delay(attempts); got != want {
+			t.Errorf("delay after %d attempts: expected %v, got %v", attempts, want, got)
+		}
+	}
+	if (RetryPolicy{MaxAttempts: 1}).Enabled() {
+		t.Error("a single attempt should not retry")
+	}
+	if d := (RetryPolicy{Backoff: time.Second}).Delay(100); d <= 0 {
+		t.Errorf("unbounded delay overflowed: %v", d)
+	}
+}
+
+func TestFunctionConfigMerge(t *testing.T) {
+	s := NewServer(Config{
+		FunctionDefaults: FunctionConfig{Retry: RetryPolicy{MaxAttempts: 3, Backoff: time.Second}},
+		Functions: map[string]FunctionConfig{
+			"f": {Retry: RetryPolicy{MaxAttempts: 5}},
+		},
+	})
+	if fc := s.functionConfig("f"); fc.Retry.MaxAttempts != 5 || fc.Retry.Backoff != time.Second {
+		t.Errorf("unexpected config for f: %+v", fc)
+	}
+	if fc := s.functionConfig("g"); fc.Retry.MaxAttempts != 3 {
+		t.Errorf("unexpected config for g: %+v", fc)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{Storage: t.TempDir()})
+	client := dialTestServer(t, s)
+	failed := client.submit(PT_SubmitJobBG, "dl", "u1", "")
+	thrown := client.submit(PT_SubmitJobBG, "dl", "u2", "")
+	foreground := client.submit(PT_SubmitJob, "dl", "u3", "")
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("dl"))
+	worker.grab()
+	worker.send(PT_WorkFail, []byte(failed))
+	worker.grab()
+	worker.send(PT_WorkException, []byte(thrown), []byte("bad\tinput"))
+	worker.grab()
+	worker.send(PT_WorkFail, []byte(foreground))
+	client.expect(PT_WorkFail)
+
+	admin := dialAdmin(t, s)
+	deadJobs, err := admin.DeadJobs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadJobs) != 2 {
+		t.Fatalf("expected the background jobs to be dead-lettered, got %+v", deadJobs)
+	}
+	if dj := deadJobs[0]; dj.Handle != failed || dj.Reason != outcomeFailed || dj.Attempts != 1 || dj.UniqueID != "u1" {
+		t.Errorf("unexpected dead job %+v", dj)
+	}
+	if dj := deadJobs[1]; dj.Handle != thrown || dj.Reason != outcomeException || dj.Exception != "bad\tinput" {
+		t.Errorf("unexpected dead job %+v", dj)
+	}
+	if err := s.store.Get(&DeadJob{Job: Job{Handle: thrown}}); err != nil {
+		t.Errorf("dead job not persisted: %v", err)
+	}
+	if deadJobs, _ := admin.DeadJobs("other"); len(deadJobs) != 0 {
+		t.Errorf("expected no dead jobs of other functions, got %+v", deadJobs)
+	}
+
+	//a requeued job runs again under its handle
+	if ok, err := admin.RequeueDeadJob(thrown); !ok {
+		t.Fatalf("requeue failed: %v", err)
+	}
+	job := worker.grab()
+	if job == nil || string(job[0]) != thrown {
+		t.Fatalf("expected requeued job %v, got %q", thrown, job)
+	}
+	worker.send(PT_WorkComplete, []byte(thrown), nil)
+	if ok, _ := admin.RequeueDeadJob(thrown); ok {
+		t.Error("a requeued job should no longer be dead-lettered")
+	}
+
+	if ok, err := admin.PurgeDeadJobs(""); !ok {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if deadJobs, _ := admin.DeadJobs(""); len(deadJobs) != 0 {
+		t.Errorf("expected no dead jobs after purge, got %+v", deadJobs)
+	}
+	if err := s.store.Get(&DeadJob{Job: Job{Handle: failed}}); err == nil {
+		t.Error("purged dead job still persisted")
+	}
+}
+
+func TestExceptionsOption(t *testing.T) {
+	s := newTestServer(t)
+	opted := dialTestServer(t, s)
+	opted.send(PT_OptionReq, []byte("exceptions"))
+	if args := opted.expect(PT_OptionRes); string(args[0]) != "exceptions" {
+		t.Errorf("unexpected option reply %q", args)
+	}
+	plain := dialTestServer(t, s)
+	handle := opted.submit(PT_SubmitJob, "exc", "u1", "")
+	if coalesced := plain.submit(PT_SubmitJob, "exc", "u1", ""); coalesced != handle {
+		t.Fatalf("submission not coalesced: %v and %v", handle, coalesced)
+	}
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("exc"))
+	worker.waitJob()
+	worker.send(PT_WorkException, []byte(handle), []byte("boom"))
+	if args := opted.expect(PT_WorkException); string(args[0]) != handle || string(args[1]) != "boom" {
+		t.Errorf("unexpected exception %q", args)
+	}
+	//a client which didn't opt in only learns that the job failed
+	if args := plain.expect(PT_WorkFail); string(args[0]) != handle {
+		t.Errorf("unexpected failure %q", args)
+	}
+}
+
+func TestResetAbilities(t *testing.T) {
+	s := newTestServer(t)
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("a"))
+	worker.send(PT_CanDo, []byte("b"))
+	worker.send(PT_ResetAbilities)
+	worker.grab() //the reset is handled once the grab is answered
+	client := dialTestServer(t, s)
+	client.submit(PT_SubmitJobBG, "a", "", "")
+	if job := worker.grab(); job != nil {
+		t.Fatalf("a reset worker got job %q", job)
+	}
+	for _, funcName := range []string{"a", "b"} {
+		if fs := getFunction(t, s, funcName); fs.Workers != 0 {
+			t.Errorf("function %v still has %v workers", funcName, fs.Workers)
+		}
+	}
+
+	//the worker registers again afterwards
+	worker.send(PT_CanDo, []byte("a"))
+	if job := worker.waitJob(); string(job[1]) != "a" {
+		t.Errorf("unexpected job %q", job)
+	}
+}
+
+func TestAllYours(t *testing.T) {
+	s := newTestServer(t)
+	worker := dialTestServer(t, s)
+	worker.send(PT_AllYours)
+	worker.send(PT_CanDo, []byte("mine"))
+	client := dialTestServer(t, s)
+	handle := client.submit(PT_SubmitJobBG, "mine", "", "")
+	if job := worker.waitJob(); string(job[0]) != handle {
+		t.Fatalf("grabbed %q instead of %v", job, handle)
+	}
+
+	e := &event{tp: ctrlGetWorker, args: &Tuple{t0: "mine"}, result: createResCh()}
+	s.ctrlEvtCh <- e
+	var workers []map[string]interface{}
+	if err := json.Unmarshal([]byte((<-e.result).(string)), &workers); err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 1 || workers[0]["allYours"] != true {
+		t.Errorf("unexpected workers %v", workers)
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	s := newTestServer(t)
+	c := dialTestServer(t, s)
+	expectError := func(code string) {
+		t.Helper()
+		if args := c.expect(PT_Error); string(args[0]) != code {
+			t.Errorf("expected %v, got %q", code, args)
+		}
+	}
+
+	c.send(PT_SubmitJobSched, []byte("f"), nil, []byte("61"), []byte("*"), []byte("*"), []byte("*"), []byte("*"), nil)
+	expectError("INVALID_SCHEDULE")
+	c.send(PT_SubmitJobEpoch, []byte("f"), nil, []byte("soon"), nil)
+	expectError("INVALID_SCHEDULE")
+	c.send(PT_SubmitJob, []byte("no separators"))
+	expectError("INVALID_PACKET")
+	c.send(PT(99), []byte("unknown"))
+	expectError("UNSUPPORTED_PACKET")
+	c.send(PT_Noop)
+	expectError("UNSUPPORTED_PACKET")
+
+	//the connection is still usable
+	c.send(PT_EchoReq, []byte("ping"))
+	if args := c.expect(PT_EchoRes); string(args[0]) != "ping" {
+		t.Errorf("unexpected echo %q", args)
+	}
+	c.send(PT_SubmitJobEpoch, []byte("f"), nil, []byte("4102444800"), nil)
+	c.expect(PT_JobCreated)
+}
+
+func TestRejectUnknownFunctions(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		RejectUnknownFunctions: true,
+		Functions:              map[string]FunctionConfig{"configured": {}},
+	})
+	c := dialTestServer(t, s)
+	c.send(PT_SubmitJobBG, []byte("nobody"), nil, nil)
+	if args := c.expect(PT_Error); string(args[0]) != "UNKNOWN_FUNCTION" {
+		t.Errorf("unexpected reply %q", args)
+	}
+	c.send(PT_SubmitJobEpoch, []byte("nobody"), nil, []byte("4102444800"), nil)
+	if args := c.expect(PT_Error); string(args[0]) != "UNKNOWN_FUNCTION" {
+		t.Errorf("unexpected reply %q", args)
+	}
+	c.submit(PT_SubmitJobBG, "configured", "", "")
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("nobody"))
+	worker.grab() //the CAN_DO is handled once the grab is answered
+	c.submit(PT_SubmitJobBG, "nobody", "", "")
+}
+
+func TestRequeueJobsOfDisconnectedWorker(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"limited": {Retry: RetryPolicy{MaxAttempts: 2}},
+		},
+	})
+	client := dialTestServer(t, s)
+	first := client.submit(PT_SubmitJobBG, "lost", "u1", "")
+	second := client.submit(PT_SubmitJobBG, "lost", "u2", "")
+
+	gone := dialTestServer(t, s)
+	gone.send(PT_CanDo, []byte("lost"))
+	gone.grab()
+	gone.grab()
+	third := client.submit(PT_SubmitJobBG, "lost", "u3", "")
+
+	sleeper := dialTestServer(t, s)
+	sleeper.send(PT_CanDo, []byte("lost"))
+	sleeper.send(PT_PreSleep)
+	sleeper.expect(PT_Noop) //woken for the third job
+	gone.conn.Close()
+	sleeper.expect(PT_Noop) //woken again for the requeued jobs
+	for _, handle := range []string{first, second, third} {
+		job := sleeper.grab()
+		if job == nil || string(job[0]) != handle {
+			t.Fatalf("expected job %v, got %q", handle, job)
+		}
+	}
+	if fs := getFunction(t, s, "lost"); fs.Outcomes[outcomeRequeued] != 2 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+
+	//a job fails once its worker disconnected on the last attempt
+	limited := client.submit(PT_SubmitJob, "limited", "u4", "")
+	w1 := dialTestServer(t, s)
+	w1.send(PT_CanDo, []byte("limited"))
+	if job := w1.grab(); job == nil || string(job[0]) != limited {
+		t.Fatalf("expected job %v, got %q", limited, job)
+	}
+	w2 := dialTestServer(t, s)
+	w2.send(PT_CanDo, []byte("limited"))
+	w1.conn.Close()
+	if job := w2.waitJob(); string(job[0]) != limited {
+		t.Fatalf("expected job %v, got %q", limited, job)
+	}
+	w2.conn.Close()
+	if args := client.expect(PT_WorkFail); string(args[0]) != limited {
+		t.Errorf("unexpected WORK_FAIL %q", args)
+	}
+	if fs := getFunction(t, s, "limited"); fs.Outcomes[outcomeRequeued] != 1 || fs.Outcomes[outcomeExhausted] != 1 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+}
+
+func TestShutdownDrainsRunningJobs(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServerWithConfig(t, Config{Storage: dir})
+	client := dialTestServer(t, s)
+	running := client.submit(PT_SubmitJobBG, "drain", "u1", "")
+	queued := client.submit(PT_SubmitJobBG, "drain", "u2", "")
+
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("drain"))
+	worker.grab()
+
+	//enter drain mode before Shutdown waits for the running job
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Drain(expired); err != context.Canceled {
+		t.Errorf("unexpected drain error %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	if job := worker.grab(); job != nil {
+		t.Fatalf("job %q handed out while draining", job)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown finished with a running job: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	worker.send(PT_WorkComplete, []byte(running), nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := leveldbq.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Get(&Job{Handle: running}); err == nil {
+		t.Errorf("completed job %v still persisted", running)
+	}
+	if err := store.Get(&Job{Handle: queued}); err != nil {
+		t.Errorf("queued job %v not persisted: %v", queued, err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	running := client.submit(PT_SubmitJobBG, "drain", "u1", "")
+	client.submit(PT_SubmitJobBG, "drain", "u2", "")
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("drain"))
+	worker.grab()
+
+	if ok, err := dialAdmin(t, s).Drain(); !ok {
+		t.Fatal(err)
+	}
+	if job := worker.grab(); job != nil {
+		t.Fatalf("job %q handed out while draining", job)
+	}
+	client.send(PT_SubmitJobBG, []byte("drain"), []byte(""), []byte(""))
+	if args := client.expect(PT_Error); string(args[0]) != "SHUTTING_DOWN" {
+		t.Errorf("unexpected error %q", args)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Drain(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("drain finished with a running job: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	worker.send(PT_WorkComplete, []byte(running), nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	//a drained server keeps running until it is shut down
+	select {
+	case <-s.closing:
+		t.Error("drain shut the server down")
+	default:
+	}
+	if fs := getFunction(t, s, "drain"); fs.Running != 0 || fs.Normal != 1 {
+		t.Errorf("unexpected function status %+v", fs)
+	}
+}
+
+func TestSubmitDuringShutdown(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{Storage: "memory://"})
+	client := dialTestServer(t, s)
+	client.submit(PT_SubmitJobBG, "late", "", "")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//the storage is closed, an open connection must not add jobs
+	client.send(PT_SubmitJobBG, []byte("late"), []byte(""), []byte(""))
+	if args := client.expect(PT_Error); string(args[0]) != "SHUTTING_DOWN" {
+		t.Errorf("unexpected error %q", args)
+	}
+	client.send(PT_SubmitJobEpoch, []byte("late"), []byte(""), []byte("1"), []byte(""))
+	if args := client.expect(PT_Error); string(args[0]) != "SHUTTING_DOWN" {
+		t.Errorf("unexpected error %q", args)
+	}
+}
+
+func TestAdminShutdownStoresRunningJobsAsQueued(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServerWithConfig(t, Config{Storage: dir})
+	client := dialTestServer(t, s)
+	handle := client.submit(PT_SubmitJobBG, "stop", "u1", "")
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("stop"))
+	worker.grab()
+
+	if ok, err := dialAdmin(t, s).Shutdown(false); !ok {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown waits for running jobs")
+	}
+
+	store, err := leveldbq.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	j := &Job{Handle: handle}
+	if err := store.Get(j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Running || j.ProcessBy != 0 {
+		t.Errorf("running job persisted as running: %+v", j)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	running := client.submit(PT_SubmitJobBG, "admin", "u1", "")
+	queued := client.submit(PT_SubmitJobBG, "admin", "", "")
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("admin"))
+	worker.grab()
+
+	admin := dialAdmin(t, s)
+	jobs, err := admin.ShowJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Handle != running || jobs[0].Queued || jobs[1].Handle != queued || !jobs[1].Queued {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+	if uniques, err := admin.ShowUniqueJobs(); err != nil || len(uniques) != 1 || uniques[0] != "u1" {
+		t.Errorf("unexpected unique jobs %v (%v)", uniques, err)
+	}
+
+	if ok, err := admin.CreateFunction("empty"); !ok {
+		t.Fatal(err)
+	}
+	if ok, err := admin.MaxQueue("empty", 1, 2, 3); !ok {
+		t.Fatal(err)
+	}
+	if ok, _ := admin.DropFunction("admin"); ok {
+		t.Error("dropped a function with workers and jobs")
+	}
+	if ok, err := admin.DropFunction("empty"); !ok {
+		t.Error(err)
+	}
+	if ok, _ := admin.DropFunction("empty"); ok {
+		t.Error("dropped an unknown function")
+	}
+	if ok, _ := admin.MaxQueue("admin", 1, 2); ok {
+		t.Error("accepted two queue sizes")
+	}
+
+	if pid, err := admin.GetPid(); err != nil || pid != os.Getpid() {
+		t.Errorf("unexpected pid %v (%v)", pid, err)
+	}
+	if version, err := admin.Version(); err != nil || version != Version {
+		t.Errorf("unexpected version %v (%v)", version, err)
+	}
+	level, err := admin.Verbose()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("v", level)
+	if got, err := admin.SetVerbose(4); err != nil || got != "4" || !bool(glog.V(4)) {
+		t.Errorf("verbose level not changed: %v (%v)", got, err)
+	}
+}
+
+func TestMaxQueueRejectsSubmissions(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"bounded": {MaxQueue: QueueLimit{Normal: 1}},
+		},
+	})
+	client := dialTestServer(t, s)
+	client.submit(PT_SubmitJobBG, "bounded", "u1", "")
+	client.send(PT_SubmitJob, []byte("bounded"), []byte("u2"), nil)
+	if args := client.expect(PT_Error); string(args[0]) != "QUEUE_ERROR" {
+		t.Errorf("unexpected error %q", args)
+	}
+	//other priorities and coalesced submissions are not limited
+	client.submit(PT_SubmitJobHighBG, "bounded", "u3", "")
+	client.submit(PT_SubmitJob, "bounded", "u1", "")
+
+	//a limit set with maxqueue replaces the configured one
+	if ok, err := dialAdmin(t, s).MaxQueue("bounded", 2); !ok {
+		t.Fatal(err)
+	}
+	client.submit(PT_SubmitJobBG, "bounded", "u4", "")
+	client.send(PT_SubmitJobBG, []byte("bounded"), []byte("u5"), nil)
+	client.expect(PT_Error)
+
+	fs := getFunction(t, s, "bounded")
+	if fs.MaxQueue != (QueueLimit{High: 2, Normal: 2, Low: 2}) {
+		t.Errorf("unexpected queue limit %+v", fs.MaxQueue)
+	}
+	if fs.Outcomes[outcomeRejected] != 2 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+}
+
+func TestForegroundJobsAreNotPersisted(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Storage: "memory://",
+		Functions: map[string]FunctionConfig{
+			"durable": {Persist: PersistAll},
+			"scratch": {Persist: PersistNone},
+		},
+	})
+	stored := func(handle string) bool {
+		t.Helper()
+		//the submission is done once the event loop answers another event
+		getFunction(t, s, "plain")
+		return s.store.Get(&Job{Handle: handle}) == nil
+	}
+
+	client := dialTestServer(t, s)
+	if stored(client.submit(PT_SubmitJob, "plain", "", "")) {
+		t.Error("foreground job persisted")
+	}
+	if !stored(client.submit(PT_SubmitJobBG, "plain", "", "")) {
+		t.Error("background job not persisted")
+	}
+	if !stored(client.submit(PT_SubmitJob, "durable", "", "")) {
+		t.Error("foreground job of a persist: all function not persisted")
+	}
+	if stored(client.submit(PT_SubmitJobBG, "scratch", "", "")) {
+		t.Error("background job of a persist: none function persisted")
+	}
+
+	//the option of the connection replaces the configuration
+	persisting := dialTestServer(t, s)
+	persisting.send(PT_OptionReq, []byte("persist"))
+	if args := persisting.expect(PT_OptionRes); string(args[0]) != "persist" {
+		t.Errorf("unexpected option reply %q", args)
+	}
+	if !stored(persisting.submit(PT_SubmitJob, "plain", "", "")) {
+		t.Error("foreground job of a persist connection not persisted")
+	}
+	transient := dialTestServer(t, s)
+	transient.send(PT_OptionReq, []byte("transient"))
+	transient.expect(PT_OptionRes)
+	handle := transient.submit(PT_SubmitJobBG, "plain", "", "")
+	if stored(handle) {
+		t.Error("background job of a transient connection persisted")
+	}
+
+	//finishing a transient job doesn't touch the storage either
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("scratch"))
+	args := worker.waitJob()
+	worker.send(PT_WorkComplete, args[0], nil)
+	if fs := getFunction(t, s, "scratch"); fs.Outcomes[outcomeCompleted] != 1 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+
+	transient.send(PT_OptionReq, []byte("nosuchoption"))
+	if args := transient.expect(PT_Error); string(args[0]) != "UNKNOWN_OPTION" {
+		t.Errorf("unexpected error %q", args)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := newTestServer(t)
+	client := dialTestServer(t, s)
+	normal := client.submit(PT_SubmitJobBG, "move", "u1", "a")
+	running := client.submit(PT_SubmitJobHighBG, "move", "u2", "b")
+	low := client.submit(PT_SubmitJobLowBG, "move", "", "c")
+	high := client.submit(PT_SubmitJobHighBG, "move", "", "d")
+	client.send(PT_SubmitJobEpoch, []byte("move"), []byte("later"), []byte("4102444800"), []byte("e"))
+	epoch := string(client.expect(PT_JobCreated)[0])
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("move"))
+	if args := worker.grab(); string(args[0]) != running {
+		t.Fatalf("grabbed %q instead of %v", args[0], running)
+	}
+
+	file := t.TempDir() + "/snapshot.json"
+	if ok, err := dialAdmin(t, s).Snapshot(file); !ok {
+		t.Fatal(err)
+	}
+	snap := s.Snapshot()
+	if len(snap.Jobs) != 4 || len(snap.CronJobs) != 1 {
+		t.Fatalf("snapshot has %v jobs and %v cron jobs", len(snap.Jobs), len(snap.CronJobs))
+	}
+	if q := snap.Queues["move"]; len(q) != 3 || q[0] != high || q[1] != normal || q[2] != low {
+		t.Errorf("unexpected queue %v", q)
+	}
+
+	moved := newTestServerWithConfig(t, Config{Storage: "memory://"})
+	if err := moved.RestoreFile(file); err != nil {
+		t.Fatal(err)
+	}
+	//a second restore doesn't duplicate anything
+	if err := moved.RestoreFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if fs := getFunction(t, moved, "move"); fs.High != 2 || fs.Normal != 1 || fs.Low != 1 {
+		t.Errorf("unexpected queues %+v", fs)
+	}
+	if cj, ok := moved.getCronJobFromMap(epoch); !ok || cj.JobTemplete.Id != "later" {
+		t.Errorf("epoch job %v not restored", epoch)
+	}
+	if err := moved.store.Get(&Job{Handle: normal}); err != nil {
+		t.Errorf("restored job not persisted: %v", err)
+	}
+
+	//the running job is handed out first, then the queue in its order
+	mover := dialTestServer(t, moved)
+	mover.send(PT_CanDo, []byte("move"))
+	for _, want := range []string{running, high, normal, low} {
+		args := mover.waitJob()
+		if string(args[0]) != want {
+			t.Errorf("got %v instead of %v", string(args[0]), want)
+		}
+		mover.send(PT_WorkComplete, args[0], nil)
+	}
+	if fs := getFunction(t, moved, "move"); fs.Outcomes[outcomeCompleted] != 4 {
+		t.Errorf("unexpected outcomes %v", fs.Outcomes)
+	}
+}
+
+// getJob fetches the REST API view of a job from the event loop.
+func getJob(t *testing.T, s *Server, handle string) *Job {
+	t.Helper()
+	e := &event{tp: ctrlGetJob, handle: handle, result: createResCh()}
+	s.ctrlEvtCh <- e
+	j := &Job{}
+	if err := json.Unmarshal([]byte((<-e.result).(string)), j); err != nil {
+		t.Fatalf("job %v: %v", handle, err)
+	}
+	return j
+}
+
+func TestJobTimeouts(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"configured": {Timeout: time.Minute},
+		},
+	})
+	client := dialTestServer(t, s)
+	deadlined := dialTestServer(t, s)
+	deadlined.send(PT_OptionReq, []byte("timeout=7"))
+	deadlined.expect(PT_OptionRes)
+	deadlined.send(PT_OptionReq, []byte("timeout=soon"))
+	if args := deadlined.expect(PT_Error); string(args[0]) != "INVALID_OPTION" {
+		t.Errorf("unexpected error %q", args)
+	}
+
+	tests := []struct {
+		name    string
+		canDo   [][]byte
+		client  *testConn
+		timeout int32
+	}{
+		{"plain CAN_DO", [][]byte{[]byte("plain")}, client, 0},
+		{"decimal CAN_DO_TIMEOUT", [][]byte{[]byte("declared"), []byte("5")}, client, 5},
+		{"binary CAN_DO_TIMEOUT", [][]byte{[]byte("binary"), {0, 0, 0, 9}}, client, 9},
+		{"function config", [][]byte{[]byte("configured")}, client, 60},
+		{"worker timeout overrides config", [][]byte{[]byte("configured"), []byte("3")}, client, 3},
+		{"client deadline", [][]byte{[]byte("declared"), []byte("5")}, deadlined, 7},
+	}
+	for _, tt := range tests {
+		funcName := string(tt.canDo[0])
+		handle := tt.client.submit(PT_SubmitJobBG, funcName, "", "")
+		worker := dialTestServer(t, s)
+		if len(tt.canDo) == 2 {
+			worker.send(PT_CanDoTimeout, tt.canDo...)
+		} else {
+			worker.send(PT_CanDo, tt.canDo...)
+		}
+		if args := worker.waitJob(); string(args[0]) != handle {
+			t.Fatalf("%v: grabbed %q instead of %v", tt.name, args[0], handle)
+		}
+		j := getJob(t, s, handle)
+		if j.TimeoutSec != tt.timeout {
+			t.Errorf("%v: timeout %v instead of %v", tt.name, j.TimeoutSec, tt.timeout)
+		}
+		if want := j.ProcessAt.Add(time.Duration(tt.timeout) * time.Second); tt.timeout > 0 && !j.Deadline.Equal(want) {
+			t.Errorf("%v: deadline %v instead of %v", tt.name, j.Deadline, want)
+		}
+		if tt.timeout == 0 && !j.Deadline.IsZero() {
+			t.Errorf("%v: deadline %v without a timeout", tt.name, j.Deadline)
+		}
+		worker.send(PT_WorkComplete, []byte(handle), nil)
+		worker.conn.Close()
+	}
+}
+
+func TestParseCanDoTimeout(t *testing.T) {
+	for data, want := range map[string]int32{"30": 30, "\x00\x00\x01\x00": 256, "0": 0} {
+		if got, err := parseCanDoTimeout([]byte(data)); err != nil || got != want {
+			t.Errorf("%q: %v (%v) instead of %v", data, got, err, want)
+		}
+	}
+	if _, err := parseCanDoTimeout([]byte("later")); err == nil {
+		t.Error("parsed an invalid timeout")
+	}
+}
+
+func TestConcurrentTimeoutsAndCompletions(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		Functions: map[string]FunctionConfig{
+			"race": {Timeout: 20 * time.Millisecond},
+		},
+	})
+	const jobs = 60
+	client := dialTestServer(t, s)
+	for i := 0; i < jobs; i++ {
+		client.submit(PT_SubmitJobBG, "race", "", "")
+	}
+
+	done := make(chan struct{})
+	for n := 0; n < 4; n++ {
+		worker := dialTestServer(t, s)
+		worker.send(PT_CanDo, []byte("race"))
+		slow := n%2 == 1
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				worker.send(PT_GrabJobUniq)
+				tp, args := worker.recv()
+				for tp == PT_Noop {
+					tp, args = worker.recv()
+				}
+				if tp != PT_JobAssignUniq {
+					return
+				}
+				if slow {
+					//reported after the deadline, the job already failed
+					time.Sleep(30 * time.Millisecond)
+				}
+				worker.send(PT_WorkComplete, args[0], nil)
+			}
+		}()
+	}
+	for n := 0; n < 4; n++ {
+		<-done
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fs := getFunction(t, s, "race")
+		completed, failed := fs.Outcomes[outcomeCompleted], fs.Outcomes[outcomeFailed]
+		if completed+failed == jobs && fs.Running == 0 {
+			if completed == 0 || failed == 0 {
+				t.Errorf("%v completed and %v timed out", completed, failed)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v completed and %v timed out of %v jobs", completed, failed, jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestConcurrentStateAccess runs clients, workers, scheduled jobs, admin
+// commands and metrics scrapes at once, for go test -race.
+func TestConcurrentStateAccess(t *testing.T) {
+	s := newTestServer(t)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics.NewServerCollector(s))
+	const jobs = 100
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(3)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := reg.Gather(); err != nil {
+				t.Errorf("gather: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		admin := dialAdmin(t, s)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			admin.Status()
+			admin.Workers()
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Snapshot()
+			for _, tp := range []PT{ctrlGetJob, ctrlGetFunction, ctrlGetCronJob} {
+				e := &event{tp: tp, result: createResCh()}
+				s.ctrlEvtCh <- e
+				<-e.result
+			}
+			e := &event{tp: ctrlGetWorker, args: &Tuple{t0: ""}, result: createResCh()}
+			s.ctrlEvtCh <- e
+			<-e.result
+		}
+	}()
+
+	client := dialTestServer(t, s)
+	for i := 0; i < jobs; i++ {
+		client.submit(PT_SubmitJobBG, "stress", "", "")
+	}
+	//epoch jobs are added by timers, a later one is cancelled by the admin protocol
+	for _, at := range []time.Duration{0, 0, time.Hour} {
+		epoch := strconv.FormatInt(time.Now().Add(at).Unix(), 10)
+		client.send(PT_SubmitJobEpoch, []byte("stress"), nil, []byte(epoch), nil)
+		handle := string(client.expect(PT_JobCreated)[0])
+		if at > 0 {
+			if ok, err := dialAdmin(t, s).Cancel(handle); !ok || err != nil {
+				t.Fatalf("cancel %v: %v", handle, err)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	for n := 0; n < 4; n++ {
+		worker := dialTestServer(t, s)
+		worker.send(PT_CanDo, []byte("stress"))
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				worker.send(PT_GrabJobUniq)
+				tp, args := worker.recv()
+				for tp == PT_Noop {
+					tp, args = worker.recv()
+				}
+				if tp != PT_JobAssignUniq {
+					time.Sleep(5 * time.Millisecond)
+					continue
+				}
+				worker.send(PT_WorkComplete, args[0], nil)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fs := getFunction(t, s, "stress")
+		if fs.Outcomes[outcomeCompleted] == jobs+2 && fs.Running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v of %v jobs completed", fs.Outcomes[outcomeCompleted], jobs+2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	readers.Wait()
+	for n := 0; n < 4; n++ {
+		<-done
+	}
+	if got := s.Jobs(); got != 0 {
+		t.Errorf("%v jobs left", got)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{MaxConnectionsPerIP: 1})
+	dial := func() *testConn {
+		srvConn, cliConn := net.Pipe()
+		go s.serveConn(srvConn)
+		t.Cleanup(func() { cliConn.Close() })
+		return &testConn{t: t, conn: cliConn, r: bufio.NewReader(cliConn)}
+	}
+	first := dial()
+	first.send(PT_EchoReq, []byte("ping"))
+	first.expect(PT_EchoRes)
+
+	//all pipes share a remote address
+	second := dial()
+	second.send(PT_EchoReq, []byte("ping"))
+	if args := second.expect(PT_Error); string(args[0]) != "TOO_MANY_CONNECTIONS" {
+		t.Errorf("unexpected error %q", args)
+	}
+	if got := s.RejectedConnections()[rejectMaxConnectionsPerIP]; got != 1 {
+		t.Errorf("%v rejected connections counted", got)
+	}
+	if got := s.Connections(); got != 1 {
+		t.Errorf("%v open connections", got)
+	}
+
+	first.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Connections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection still counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third := dial()
+	third.send(PT_EchoReq, []byte("ping"))
+	third.expect(PT_EchoRes)
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{MaxPacketSize: 16})
+	c := dialTestServer(t, s)
+	c.send(PT_EchoReq, []byte("small"))
+	c.expect(PT_EchoRes)
+
+	//the header claims 1 GiB, the server must not wait for or allocate it
+	header := &bytes.Buffer{}
+	header.WriteString(ReqStr)
+	binary.Write(header, binary.BigEndian, PT_EchoReq.Uint32())
+	binary.Write(header, binary.BigEndian, uint32(1<<30))
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write(header.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if args := c.expect(PT_Error); string(args[0]) != "PACKET_TOO_LARGE" {
+		t.Errorf("unexpected error %q", args)
+	}
+	if _, _, err := ReadMessage(c.r); err == nil {
+		t.Error("connection still open")
+	}
+	if got := s.RejectedConnections()[rejectPacketTooLarge]; got != 1 {
+		t.Errorf("%v rejected connections counted", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{IdleTimeout: 50 * time.Millisecond})
+	idle := dialTestServer(t, s)
+	idle.send(PT_EchoReq, []byte("ping"))
+	idle.expect(PT_EchoRes)
+	//a worker which registered its functions but neither grabs nor sleeps
+	registered := dialTestServer(t, s)
+	registered.send(PT_CanDo, []byte("other"))
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("slow"))
+	worker.send(PT_PreSleep)
+
+	if args := idle.expect(PT_Error); string(args[0]) != "IDLE_TIMEOUT" {
+		t.Errorf("unexpected error %q", args)
+	}
+	if args := registered.expect(PT_Error); string(args[0]) != "IDLE_TIMEOUT" {
+		t.Errorf("unexpected error %q", args)
+	}
+	time.Sleep(100 * time.Millisecond)
+	//a sleeping worker, a worker running a job and a client waiting for
+	//its job are not idle
+	waiting := dialTestServer(t, s)
+	handle := waiting.submit(PT_SubmitJob, "slow", "", "")
+	worker.expect(PT_Noop)
+	if job := worker.waitJob(); string(job[0]) != handle {
+		t.Fatalf("grabbed %q instead of %v", job, handle)
+	}
+	time.Sleep(100 * time.Millisecond)
+	worker.send(PT_WorkComplete, []byte(handle), []byte("done"))
+	if args := waiting.expect(PT_WorkComplete); string(args[1]) != "done" {
+		t.Errorf("unexpected result %q", args)
+	}
+	if got := s.RejectedConnections()[rejectIdleTimeout]; got != 2 {
+		t.Errorf("%v idle connections counted", got)
+	}
+}
+
+func TestReadTimeoutWithoutIdleTimeout(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{ReadTimeout: 50 * time.Millisecond})
+	c := dialTestServer(t, s)
+	c.send(PT_EchoReq, []byte("ping"))
+	c.expect(PT_EchoRes)
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("slow"))
+
+	//waiting for the next request is not limited by the read timeout
+	time.Sleep(200 * time.Millisecond)
+	c.send(PT_EchoReq, []byte("pong"))
+	if args := c.expect(PT_EchoRes); string(args[0]) != "pong" {
+		t.Errorf("unexpected echo %q", args)
+	}
+	handle := c.submit(PT_SubmitJobBG, "slow", "", "")
+	if job := worker.waitJob(); string(job[0]) != handle {
+		t.Fatalf("grabbed %q instead of %v", job, handle)
+	}
+	if got := s.RejectedConnections()[rejectIdleTimeout]; got != 0 {
+		t.Errorf("%v idle connections counted", got)
+	}
+
+	//a started request still has to finish in time
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write([]byte(ReqStr)); err != nil {
+		t.Fatal(err)
+	}
+	if args := c.expect(PT_Error); string(args[0]) != "READ_TIMEOUT" {
+		t.Errorf("unexpected error %q", args)
+	}
+}
+
+// gatedStore holds back the writes of jobs until gate is closed, and fails
+// them with err.
+type gatedStore struct {
+	storage.Db
+	gate   chan struct{}
+	err    error
+	stored int32
+}
+
+func (g *gatedStore) Add(item storage.DbItem) error {
+	if _, ok := item.(*Job); ok {
+		<-g.gate
+		if g.err != nil {
+			return g.err
+		}
+		atomic.StoreInt32(&g.stored, 1)
+	}
+	return g.Db.Add(item)
+}
+
+func newGatedServer(t *testing.T, store *gatedStore) *Server {
+	s := NewServer(Config{})
+	s.store = store
+	go s.EvtLoop()
+	return s
+}
+
+func TestSubmitRepliesAfterStore(t *testing.T) {
+	store := &gatedStore{Db: memory.New(), gate: make(chan struct{})}
+	s := newGatedServer(t, store)
+	c := dialTestServer(t, s)
+	c.send(PT_SubmitJobBG, []byte("f"), []byte(""), []byte("data"))
+	time.AfterFunc(50*time.Millisecond, func() { close(store.gate) })
+	c.expect(PT_JobCreated)
+	if atomic.LoadInt32(&store.stored) == 0 {
+		t.Error("JOB_CREATED sent before the job was stored")
+	}
+
+	failing := &gatedStore{Db: memory.New(), gate: make(chan struct{}), err: errors.New("disk full")}
+	close(failing.gate)
+	s = newGatedServer(t, failing)
+	c = dialTestServer(t, s)
+	c.send(PT_SubmitJobBG, []byte("f"), []byte(""), []byte("data"))
+	if args := c.expect(PT_Error); string(args[0]) != "STORAGE_ERROR" {
+		t.Errorf("unexpected error %q", args)
+	}
+	worker := dialTestServer(t, s)
+	worker.send(PT_CanDo, []byte("f"))
+	if job := worker.grab(); job != nil {
+		t.Errorf("job not stored but queued: %q", job)
+	}
+}
+
+// countingStats counts the snapshots the metrics collector takes.
+type countingStats struct {
+	*Server
+	n int32
+}
+
+func (c *countingStats) ServerStats() *metrics.ServerStats {
+	atomic.AddInt32(&c.n, 1)
+	return c.Server.ServerStats()
+}
+
+func TestMetricsTakeOneSnapshot(t *testing.T) {
+	s := &countingStats{Server: newTestServer(t)}
+	c := dialTestServer(t, s.Server)
+	c.submit(PT_SubmitJobBG, "f", "", "")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics.NewServerCollector(s))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&s.n); n != 1 {
+		t.Errorf("%v snapshots for one scrape", n)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "gearman_server_job_count" && mf.GetMetric()[0].GetGauge().GetValue() != 1 {
+			t.Errorf("unexpected %v", mf)
+		}
+	}
+}
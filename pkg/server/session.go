@@ -2,8 +2,12 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +34,14 @@ func (s *session) getWorker(sessionId int64, inbox chan []byte, conn net.Conn) *
 	return s.w
 }
 
+func (s *session) getClient(sessionId int64, inbox chan []byte) *Client {
+	if s.c == nil {
+		s.c = &Client{Session: Session{SessionId: sessionId, in: inbox,
+			ConnectAt: time.Now()}}
+	}
+	return s.c
+}
+
 func (se *session) handleConnection(s *Server, conn net.Conn) {
 	sessionId := s.allocSessionId()
 	inbox := make(chan []byte, 200)
@@ -40,8 +52,8 @@ func (se *session) handleConnection(s *Server, conn net.Conn) {
 				result: createResCh()}
 			s.protoEvtCh <- e
 			<-e.result
-			close(inbox) //notify writer to quit
 		}
+		close(inbox) //notify writer to quit
 	}()
 	log.Debugf("new session with sessionId %v and address: %v", sessionId, conn.RemoteAddr())
 
@@ -52,11 +64,11 @@ func (se *session) handleConnection(s *Server, conn net.Conn) {
 	//todo:1. reuse event's result channel, create less garbage.
 	//2. heavily rely on goroutine switch, send reply in EventLoop can make it faster, but logic is not that clean
 	//so i am not going to change it right now, maybe never
-	fb, err := r.Peek(1)
-	if err != nil {
-		log.Errorln(err)
+	if err := se.waitRequest(s, conn, r); err != nil {
+		log.Debugf("%v with sessionId %v", err, sessionId)
 		return
 	}
+	fb, _ := r.Peek(1)
 	if fb[0] == byte(0) {
 		se.handleBinaryConnection(s, conn, r, sessionId, inbox)
 	} else {
@@ -68,15 +80,43 @@ func (se *session) handleConnection(s *Server, conn net.Conn) {
 func (se *session) handleBinaryConnection(s *Server, conn net.Conn, r *bufio.Reader, sessionId int64, inbox chan []byte) {
 
 	for {
-		tp, buf, err := ReadMessage(r)
-		if err != nil {
+		if err := se.waitRequest(s, conn, r); err != nil {
+			if err == idleTimeout {
+				closeWithError(conn, errorReply(idleTimeout))
+			}
+			log.Debugf("%v with sessionId %v", err, sessionId)
+			return
+		}
+		tp, buf, err := readMessage(r, s.maxPacketSize())
+		switch {
+		case err == nil:
+		case err == unknownPacketType:
+			sendReplyResult(inbox, errorReply(&codedError{code: "UNSUPPORTED_PACKET",
+				msg: fmt.Sprintf("unknown packet type %d", tp)}))
+			continue
+		case err == invalidMagic:
+			//the packets can't be told apart anymore
+			closeWithError(conn, errorReply(&codedError{code: "INVALID_PACKET", msg: err.Error()}))
+			return
+		case err == packetTooLarge:
+			s.conns.reject(rejectPacketTooLarge)
+			closeWithError(conn, errorReply(&codedError{code: "PACKET_TOO_LARGE",
+				msg: fmt.Sprintf("packets are limited to %d bytes", s.maxPacketSize())}))
+			return
+		case isTimeout(err):
+			s.conns.reject(rejectReadTimeout)
+			closeWithError(conn, errorReply(readTimeout))
+			return
+		default:
 			log.Debugf("%v with sessionId %v", err, sessionId)
 			return
 		}
 		args, ok := decodeArgs(tp, buf)
 		if !ok {
 			log.Debugf("protocol: %v argc not match details: %s", tp.String(), string(buf))
-			return
+			sendReplyResult(inbox, errorReply(&codedError{code: "INVALID_PACKET",
+				msg: fmt.Sprintf("%v takes %d arguments", tp, tp.ArgCount())}))
+			continue
 		}
 
 		log.Debugf("incoming<= sessionId: %v protocol: %v len(args): %v details: %s", sessionId, tp.String(), len(args), string(buf))
@@ -98,10 +138,13 @@ func (se *session) handleBinaryConnection(s *Server, conn net.Conn, r *bufio.Rea
 		case PT_PreSleep:
 			se.w = se.getWorker(sessionId, inbox, conn)
 			s.protoEvtCh <- &event{tp: tp, args: &Tuple{t0: se.w}, fromSessionId: sessionId}
+		case PT_ResetAbilities, PT_AllYours:
+			se.w = se.getWorker(sessionId, inbox, conn)
+			s.protoEvtCh <- &event{tp: tp, args: &Tuple{t0: se.w}, fromSessionId: sessionId}
 		case PT_SetClientId:
 			se.w = se.getWorker(sessionId, inbox, conn)
 			s.protoEvtCh <- &event{tp: tp, args: &Tuple{t0: se.w, t1: string(args[0])}}
-		case PT_GrabJobUniq:
+		case PT_GrabJob, PT_GrabJobUniq, PT_GrabJobAll:
 			if se.w == nil {
 				log.Errorf("can't perform %s, need send CAN_DO first", tp.String())
 				return
@@ -116,44 +159,40 @@ func (se *session) handleBinaryConnection(s *Server, conn net.Conn, r *bufio.Rea
 				break
 			}
 
-			sendReply(inbox, PT_JobAssignUniq, [][]byte{
-				[]byte(job.Handle), []byte(job.FuncName), []byte(job.Id), job.Data})
+			sendReplyResult(inbox, jobAssignReply(tp, job))
 		case PT_SubmitJobLow, PT_SubmitJob, PT_SubmitJobHigh, PT_SubmitJobLowBG, PT_SubmitJobBG, PT_SubmitJobHighBG:
-			if se.c == nil {
-				se.c = &Client{Session: Session{SessionId: sessionId, in: inbox,
-					ConnectAt: time.Now()}}
-			}
+			se.c = se.getClient(sessionId, inbox)
 			e := &event{tp: tp,
 				args:   &Tuple{t0: se.c, t1: args[0], t2: args[1], t3: args[2]},
 				result: createResCh(),
 			}
 			s.protoEvtCh <- e
-			handle := <-e.result
-			sendReply(inbox, PT_JobCreated, [][]byte{[]byte(handle.(string))})
-		case PT_SubmitJobSched:
-			if se.c == nil {
-				se.c = &Client{Session: Session{SessionId: sessionId, in: inbox,
-					ConnectAt: time.Now()}}
+			sendSubmitResult(inbox, <-e.result)
+		case PT_SubmitReduceJob, PT_SubmitReduceJobBackground:
+			se.c = se.getClient(sessionId, inbox)
+			//args: function, unique, reducer, aggregator (unused), data
+			e := &event{tp: tp,
+				args:   &Tuple{t0: se.c, t1: args[0], t2: args[1], t3: args[4], t4: args[2]},
+				result: createResCh(),
 			}
+			s.protoEvtCh <- e
+			sendSubmitResult(inbox, <-e.result)
+		case PT_SubmitJobSched:
+			se.c = se.getClient(sessionId, inbox)
 			e := &event{tp: tp,
 				args:   &Tuple{t0: se.c, t1: args[0], t2: args[1], t3: args[2], t4: args[3], t5: args[4], t6: args[5], t7: args[6], t8: args[7]},
 				result: createResCh(),
 			}
 			s.protoEvtCh <- e
-			shcedJobId := <-e.result
-			sendReply(inbox, PT_JobCreated, [][]byte{[]byte(shcedJobId.(string))})
+			sendSubmitResult(inbox, <-e.result)
 		case PT_SubmitJobEpoch:
-			if se.c == nil {
-				se.c = &Client{Session: Session{SessionId: sessionId, in: inbox,
-					ConnectAt: time.Now()}}
-			}
+			se.c = se.getClient(sessionId, inbox)
 			e := &event{tp: tp,
 				args:   &Tuple{t0: se.c, t1: args[0], t2: args[1], t3: args[2], t4: args[3]},
 				result: createResCh(),
 			}
 			s.protoEvtCh <- e
-			jobId := <-e.result
-			sendReply(inbox, PT_JobCreated, [][]byte{[]byte(jobId.(string))})
+			sendSubmitResult(inbox, <-e.result)
 		case PT_GetStatus:
 			e := &event{tp: tp, args: &Tuple{t0: args[0]},
 				result: createResCh()}
@@ -164,6 +203,44 @@ func (se *session) handleBinaryConnection(s *Server, conn net.Conn, r *bufio.Rea
 				bool2bytes(resp.t1), bool2bytes(resp.t2),
 				int2bytes(resp.t3),
 				int2bytes(resp.t4)})
+		case PT_GetStatusUnique:
+			e := &event{tp: tp, args: &Tuple{t0: args[0]},
+				result: createResCh()}
+			s.protoEvtCh <- e
+
+			resp := (<-e.result).(*Tuple)
+			sendReply(inbox, PT_StatusResUnique, [][]byte{resp.t0.([]byte),
+				bool2bytes(resp.t1), bool2bytes(resp.t2),
+				int2bytes(resp.t3),
+				int2bytes(resp.t4),
+				int2bytes(resp.t5)})
+		case PT_OptionReq:
+			//options last for the connection, the reply echoes the option
+			option := string(args[0])
+			switch {
+			case strings.HasPrefix(option, "timeout="):
+				//run time limit in seconds of the jobs submitted next, 0 for none
+				timeout, err := strconv.ParseUint(strings.TrimPrefix(option, "timeout="), 10, 31)
+				if err != nil {
+					sendReplyResult(inbox, errorReply(&codedError{code: "INVALID_OPTION",
+						msg: fmt.Sprintf("invalid timeout %v", option)}))
+					continue
+				}
+				se.getClient(sessionId, inbox).timeout = int32(timeout)
+			case option == "persist":
+				se.getClient(sessionId, inbox).persist = PersistAll
+			case option == "transient":
+				se.getClient(sessionId, inbox).persist = PersistNone
+			case option == "exceptions":
+				//read by the event loop when it forwards work reports
+				s.protoEvtCh <- &event{tp: tp, args: &Tuple{t0: se.getClient(sessionId, inbox), t1: option}}
+			default:
+				log.Debugf("sessionId %v requested unknown option `%v`", sessionId, option)
+				sendReplyResult(inbox, errorReply(&codedError{code: "UNKNOWN_OPTION",
+					msg: fmt.Sprintf("unknown option %v", option)}))
+				continue
+			}
+			sendReply(inbox, PT_OptionRes, [][]byte{args[0]})
 		case PT_WorkData, PT_WorkWarning, PT_WorkStatus, PT_WorkComplete,
 			PT_WorkFail, PT_WorkException:
 			if se.w == nil {
@@ -174,15 +251,34 @@ func (se *session) handleBinaryConnection(s *Server, conn net.Conn, r *bufio.Rea
 				fromSessionId: sessionId}
 		default:
 			log.Warningf("not support type %s", tp.String())
+			sendReplyResult(inbox, errorReply(&codedError{code: "UNSUPPORTED_PACKET",
+				msg: fmt.Sprintf("%v is not supported", tp)}))
 		}
 	}
 }
 
 func (se *session) handleAdminConnection(s *Server, conn net.Conn, r *bufio.Reader, sessionId int64, inbox chan []byte) {
 	for {
-		rcv, err := r.ReadBytes('\n')
+		if err := se.waitRequest(s, conn, r); err != nil {
+			if err == idleTimeout {
+				closeWithError(conn, []byte(fmt.Sprintf("Error: %v\n", idleTimeout.msg)))
+			}
+			log.Debugf("%v with sessionId %v", err, sessionId)
+			return
+		}
+		//commands are limited to the size of the read buffer
+		rcv, err := r.ReadSlice('\n')
 		if err != nil {
-			sendTextReply(inbox, fmt.Sprintf("Error: %v\n", err))
+			switch {
+			case err == bufio.ErrBufferFull:
+				s.conns.reject(rejectPacketTooLarge)
+				closeWithError(conn, []byte("Error: command too long\n"))
+			case isTimeout(err):
+				s.conns.reject(rejectReadTimeout)
+				closeWithError(conn, []byte(fmt.Sprintf("Error: %v\n", readTimeout.msg)))
+			default:
+				sendTextReply(inbox, fmt.Sprintf("Error: %v\n", err))
+			}
 			log.Errorln(err)
 			return
 		}
@@ -192,8 +288,79 @@ func (se *session) handleAdminConnection(s *Server, conn net.Conn, r *bufio.Read
 		}
 		ap, arg := ParseTextMessage(trimedRcv)
 		switch ap {
-		case AP_Show, AP_Create, AP_Drop, AP_MaxQueue, AP_GetPid, AP_Shutdown, AP_Verbose, AP_Version:
-			sendTextError(inbox, fmt.Sprintf("command `%s` is currently unimplemented", ap))
+		case AP_Show:
+			switch strings.Join(strings.Fields(arg), " ") {
+			case "jobs":
+				e := &event{tp: ctrlShowJobs, result: createResCh()}
+				s.ctrlEvtCh <- e
+				sendTextReply(inbox, (<-e.result).(string))
+			case "unique jobs":
+				e := &event{tp: ctrlShowUniqueJobs, result: createResCh()}
+				s.ctrlEvtCh <- e
+				sendTextReply(inbox, (<-e.result).(string))
+			default:
+				sendTextError(inbox, fmt.Sprintf("Invalid show command `%s`", arg))
+			}
+		case AP_Create, AP_Drop:
+			fields := strings.Fields(arg)
+			if len(fields) != 2 || fields[0] != "function" {
+				sendTextError(inbox, fmt.Sprintf("usage: %s function <name>", ap))
+				continue
+			}
+			var tp PT = ctrlCreateFunction
+			if ap == AP_Drop {
+				tp = ctrlDropFunction
+			}
+			sendCtrlResult(s, &event{tp: tp, handle: fields[1], result: createResCh()}, inbox)
+		case AP_MaxQueue:
+			fields := strings.Fields(arg)
+			limit, err := parseQueueLimit(fields)
+			if err != nil {
+				sendTextError(inbox, err.Error())
+				continue
+			}
+			sendCtrlResult(s, &event{tp: ctrlMaxQueue, handle: fields[0],
+				args: &Tuple{t0: limit}, result: createResCh()}, inbox)
+		case AP_GetPid:
+			sendTextReply(inbox, fmt.Sprintf("OK %d\n", os.Getpid()))
+		case AP_Version:
+			sendTextReply(inbox, fmt.Sprintf("OK %s\n", Version))
+		case AP_Verbose:
+			//the verbosity of the glog V logs, 4 and above enables debug logs
+			if arg != "" {
+				if _, err := strconv.ParseUint(arg, 10, 31); err != nil {
+					sendTextError(inbox, fmt.Sprintf("Invalid verbose level `%s`", arg))
+					continue
+				}
+				if err := flag.Set("v", arg); err != nil {
+					sendTextError(inbox, err.Error())
+					continue
+				}
+				log.Infof("verbose level set to %v", arg)
+			}
+			sendTextReply(inbox, fmt.Sprintf("OK %s\n", flag.Lookup("v").Value))
+		case AP_Shutdown:
+			//a graceful shutdown waits for the running jobs, otherwise they are stored as queued
+			ctx, cancel := context.WithCancel(context.Background())
+			switch arg {
+			case "":
+				cancel()
+			case "graceful":
+			default:
+				cancel()
+				sendTextError(inbox, fmt.Sprintf("Invalid shutdown mode `%s`", arg))
+				continue
+			}
+			sendTextOK(inbox)
+			go func() {
+				defer cancel()
+				if err := s.Shutdown(ctx); err != nil {
+					log.Errorln(err)
+				}
+			}()
+		case AP_Drain:
+			//enter drain mode without waiting, `status` shows the jobs still running
+			sendCtrlResult(s, &event{tp: ctrlDrain, result: createResCh()}, inbox)
 		case AP_Cancel:
 			if IsValidCronJobHandle(arg) {
 				err := s.DeleteCronJob(&CronJob{Handle: arg})
@@ -208,60 +375,131 @@ func (se *session) handleAdminConnection(s *Server, conn net.Conn, r *bufio.Read
 				log.Errorf("invalid handle `%v`\n", arg)
 				sendTextError(inbox, fmt.Sprintf("Invalid handle `%v`, valid schedule job handle should start with `S:`\n", arg))
 			}
-		case AP_Status:
-			resp := ""
-			for fnName, v := range s.funcWorker {
-				runningCnt := 0
-				for _, j := range s.jobs {
-					if fnName == j.FuncName && j.Running {
-						runningCnt++
-					}
-				}
-				resp += fmt.Sprintf("%v\t%v\t%v\t%v\n", fnName, v.jobs.Len(), runningCnt, v.workers.Len())
+		case AP_Status, AP_PRIORITY_STATUS, AP_Workers:
+			var tp PT = ctrlStatus
+			switch ap {
+			case AP_PRIORITY_STATUS:
+				tp = ctrlPriorityStatus
+			case AP_Workers:
+				tp = ctrlWorkers
 			}
-			resp += ".\n"
-			sendTextReply(inbox, resp)
-		case AP_PRIORITY_STATUS:
-			resp := ""
-			for fnName, v := range s.funcWorker {
-				high := 0
-				normal := 0
-				low := 0
-				for _, j := range s.jobs {
-					if fnName == j.FuncName && !j.Running {
-						switch j.Priority {
-						case JobHigh:
-							high++
-						case JobNormal:
-							normal++
-						case JobLow:
-							low++
-						}
-					}
-				}
-				resp += fmt.Sprintf("%v\t%v\t%v\t%v\t%v\n", fnName, high, normal, low, v.workers.Len())
+			e := &event{tp: tp, result: createResCh()}
+			s.ctrlEvtCh <- e
+			sendTextReply(inbox, (<-e.result).(string))
+		case AP_DeadLetter:
+			se.handleDeadLetterCommand(s, arg, inbox)
+		case AP_Snapshot:
+			//the file is written on the server host, e.g. to a volume the new node mounts
+			if arg == "" {
+				sendTextError(inbox, "usage: snapshot <file>")
+				continue
 			}
-			resp += ".\n"
-			sendTextReply(inbox, resp)
-		case AP_Workers:
-			resp := ""
-			for _, v := range s.worker {
-				resp += fmt.Sprintf("%v %v %v : ", "-", v.Conn.RemoteAddr().String(), v.workerId)
-				isFirst := true
-				for fnName := range v.canDo {
-					if !isFirst {
-						resp += " "
-					}
-					isFirst = false
-					resp += fmt.Sprintf("%v", fnName)
-				}
-				resp += "\n"
+			if err := s.WriteSnapshot(arg); err != nil {
+				sendTextError(inbox, err.Error())
+				continue
 			}
-			resp += ".\n"
-			sendTextReply(inbox, resp)
+			sendTextOK(inbox)
 		default:
 			log.Errorf("Invalid command `%s`\n", ap)
 			sendTextError(inbox, fmt.Sprintf("Invalid command `%s`\n", ap))
 		}
 	}
 }
+
+// handleDeadLetterCommand serves `deadletter list [function]`,
+// `deadletter show <handle>`, `deadletter requeue <handle>` and
+// `deadletter purge [handle]`.
+func (se *session) handleDeadLetterCommand(s *Server, arg string, inbox chan []byte) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		sendTextError(inbox, "usage: deadletter list|show|requeue|purge [handle|function]")
+		return
+	}
+	param := ""
+	if len(fields) == 2 {
+		param = fields[1]
+	}
+	switch fields[0] {
+	case "list", "show":
+		e := &event{tp: ctrlGetDeadJob, args: &Tuple{t0: ""}, result: createResCh()}
+		switch {
+		case fields[0] == "list":
+			e.args.t0 = param
+		case param == "":
+			sendTextError(inbox, "usage: deadletter show <handle>")
+			return
+		default:
+			e.handle = param
+		}
+		s.ctrlEvtCh <- e
+		deadJobs := (<-e.result).([]*DeadJob)
+		if fields[0] == "show" && len(deadJobs) == 0 {
+			sendTextError(inbox, fmt.Sprintf("dead job `%v` not found", param))
+			return
+		}
+		resp := ""
+		for _, dj := range deadJobs {
+			resp += formatDeadJob(dj)
+		}
+		resp += ".\n"
+		sendTextReply(inbox, resp)
+	case "requeue":
+		if param == "" {
+			sendTextError(inbox, "usage: deadletter requeue <handle>")
+			return
+		}
+		sendCtrlResult(s, &event{tp: ctrlRequeueDeadJob, handle: param, result: createResCh()}, inbox)
+	case "purge":
+		sendCtrlResult(s, &event{tp: ctrlPurgeDeadJob, handle: param, result: createResCh()}, inbox)
+	default:
+		sendTextError(inbox, fmt.Sprintf("Invalid deadletter command `%s`", fields[0]))
+	}
+}
+
+// sendCtrlResult runs a control event which results in an error or not and
+// answers with the error or OK.
+func sendCtrlResult(s *Server, e *event, inbox chan []byte) {
+	s.ctrlEvtCh <- e
+	if err, ok := (<-e.result).(error); ok {
+		sendTextError(inbox, err.Error())
+		return
+	}
+	sendTextOK(inbox)
+}
+
+// parseQueueLimit parses the arguments of `maxqueue <function> [max | high normal low]`.
+// Without sizes the queue is unlimited.
+func parseQueueLimit(fields []string) (QueueLimit, error) {
+	usage := fmt.Errorf("usage: maxqueue <function> [max | high normal low]")
+	if len(fields) == 0 {
+		return QueueLimit{}, usage
+	}
+	sizes := make([]int, 0, 3)
+	for _, f := range fields[1:] {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return QueueLimit{}, usage
+		}
+		sizes = append(sizes, n)
+	}
+	switch {
+	case len(sizes) == 0:
+		return QueueLimit{}, nil
+	case len(sizes) == 1:
+		return QueueLimit{High: sizes[0], Normal: sizes[0], Low: sizes[0]}, nil
+	case len(sizes) == 3:
+		return QueueLimit{High: sizes[0], Normal: sizes[1], Low: sizes[2]}, nil
+	}
+	return QueueLimit{}, usage
+}
+
+// sendSubmitResult answers a job submission with JOB_CREATED, or with an
+// ERROR packet if the server rejected it.
+func sendSubmitResult(inbox chan []byte, res interface{}) {
+	switch r := res.(type) {
+	case string:
+		sendReply(inbox, PT_JobCreated, [][]byte{[]byte(r)})
+	case *codedError:
+		sendReplyResult(inbox, errorReply(r))
+	}
+}
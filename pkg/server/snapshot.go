@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/appscode/go/log"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+)
+
+// SnapshotVersion is the version of the snapshots written by this server,
+// newer snapshots are not restored.
+const SnapshotVersion = 1
+
+// Snapshot is a point-in-time copy of the work a server knows about, taken
+// by the event loop so that no job is half submitted or half handed out.
+// It moves queued and scheduled jobs to another server with their handles
+// and priorities.
+type Snapshot struct {
+	Version  int                   `json:"version"`
+	TakenAt  time.Time             `json:"taken_at"`
+	Jobs     []*Job                `json:"jobs"`   //in submission order
+	Queues   map[string][]string   `json:"queues"` //function -> handles of its queued jobs in dispatch order
+	CronJobs []*CronJob            `json:"cron_jobs"`
+	DeadJobs []*DeadJob            `json:"dead_jobs"`
+	MaxQueue map[string]QueueLimit `json:"max_queue,omitempty"` //limits set with maxqueue
+}
+
+// Snapshot returns a consistent copy of the jobs, queues and cron jobs of
+// the server.
+func (s *Server) Snapshot() *Snapshot {
+	e := &event{tp: ctrlSnapshot, result: createResCh()}
+	s.ctrlEvtCh <- e
+	return (<-e.result).(*Snapshot)
+}
+
+// Restore adds the jobs of a snapshot to the server. Jobs, cron jobs and
+// dead jobs whose handle is already known are skipped.
+func (s *Server) Restore(snap *Snapshot) error {
+	if snap.Version > SnapshotVersion {
+		return fmt.Errorf("snapshot version %v is newer than %v", snap.Version, SnapshotVersion)
+	}
+	e := &event{tp: ctrlRestore, args: &Tuple{t0: snap}, result: createResCh()}
+	s.ctrlEvtCh <- e
+	<-e.result
+	return nil
+}
+
+// WriteSnapshot takes a snapshot and writes it to a file, replacing it only
+// once the snapshot is complete.
+func (s *Server) WriteSnapshot(path string) error {
+	buf, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreFile restores a snapshot written by WriteSnapshot or the REST API.
+func (s *Server) RestoreFile(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(buf, snap); err != nil {
+		return fmt.Errorf("invalid snapshot %v: %v", path, err)
+	}
+	return s.Restore(snap)
+}
+
+func (s *Server) handleSnapshot(e *event) {
+	snap := &Snapshot{
+		Version:  SnapshotVersion,
+		TakenAt:  time.Now(),
+		Jobs:     make([]*Job, 0, len(s.jobs)),
+		Queues:   make(map[string][]string),
+		CronJobs: make([]*CronJob, 0),
+		DeadJobs: make([]*DeadJob, 0, len(s.deadJobs)),
+		MaxQueue: make(map[string]QueueLimit),
+	}
+	for _, j := range s.sortedJobs() {
+		c := *j
+		snap.Jobs = append(snap.Jobs, &c)
+	}
+	for funcName, jw := range s.funcWorker {
+		handles := make([]string, 0, jw.jobs.Len())
+		jw.jobs.Each(func(j *Job) bool {
+			handles = append(handles, j.Handle)
+			return true
+		})
+		if len(handles) > 0 {
+			snap.Queues[funcName] = handles
+		}
+	}
+	s.mu.RLock()
+	for _, cj := range s.cronJobs {
+		c := *cj
+		snap.CronJobs = append(snap.CronJobs, &c)
+	}
+	s.mu.RUnlock()
+	sort.Slice(snap.CronJobs, func(a, b int) bool { return snap.CronJobs[a].Handle < snap.CronJobs[b].Handle })
+	for _, dj := range s.deadJobs {
+		c := *dj
+		snap.DeadJobs = append(snap.DeadJobs, &c)
+	}
+	sort.Slice(snap.DeadJobs, func(a, b int) bool { return snap.DeadJobs[a].FailedAt.Before(snap.DeadJobs[b].FailedAt) })
+	for funcName, limit := range s.maxQueue {
+		snap.MaxQueue[funcName] = limit
+	}
+	e.result <- snap
+}
+
+// handleRestore adds the jobs of a snapshot. Queued jobs keep their order.
+// Jobs which were running or waiting for a retry go to the front of their
+// queues, as the jobs of a disconnected worker do, their workers can't
+// report to this server.
+func (s *Server) handleRestore(e *event) {
+	snap := e.args.t0.(*Snapshot)
+	jobs := make(map[string]*Job, len(snap.Jobs))
+	for _, j := range snap.Jobs {
+		if _, known := s.jobs[j.Handle]; !known {
+			jobs[j.Handle] = j
+		}
+	}
+	n := len(jobs)
+	restored := make(map[string]bool)
+	funcs := make([]string, 0, len(snap.Queues))
+	for funcName := range snap.Queues {
+		funcs = append(funcs, funcName)
+	}
+	sort.Strings(funcs)
+	for _, funcName := range funcs {
+		for _, handle := range snap.Queues[funcName] {
+			if j, ok := jobs[handle]; ok && j.FuncName == funcName {
+				s.restoreJob(j, false)
+				delete(jobs, handle)
+				restored[funcName] = true
+			}
+		}
+	}
+	unqueued := make([]*Job, 0, len(jobs))
+	for _, j := range jobs {
+		unqueued = append(unqueued, j)
+	}
+	sort.Slice(unqueued, func(a, b int) bool { return unqueued[a].ProcessAt.After(unqueued[b].ProcessAt) })
+	for _, j := range unqueued {
+		s.restoreJob(j, true)
+		restored[j.FuncName] = true
+	}
+
+	cronJobs := 0
+	for _, cj := range snap.CronJobs {
+		if _, known := s.getCronJobFromMap(cj.Handle); known {
+			continue
+		}
+		if _, ok := s.ExpressionToEpoch(cj.Expression); ok {
+			s.doAddEpochJob(cj)
+		} else {
+			s.doAddCronJob(cj)
+		}
+		cronJobs++
+	}
+	deadJobs := 0
+	for _, dj := range snap.DeadJobs {
+		if _, known := s.deadJobs[dj.Job.Handle]; known {
+			continue
+		}
+		s.deadJobs[dj.Job.Handle] = dj
+		if s.store != nil && !dj.Job.Transient {
+			if err := s.store.Add(dj); err != nil {
+				log.Warning(err)
+			}
+		}
+		deadJobs++
+	}
+	for funcName, limit := range snap.MaxQueue {
+		if _, ok := s.maxQueue[funcName]; !ok {
+			s.getJobWorkPair(funcName)
+			s.maxQueue[funcName] = limit
+		}
+	}
+	for funcName := range restored {
+		s.wakeupWorker(funcName)
+	}
+	log.Infof("restored %v jobs, %v cron jobs and %v dead jobs of a snapshot taken at %v",
+		n, cronJobs, deadJobs, snap.TakenAt)
+	e.result <- nil
+}
+
+// restoreJob queues a job of a snapshot under its handle.
+func (s *Server) restoreJob(j *Job, front bool) {
+	j.Running = false
+	j.Deadline = time.Time{}
+	j.ProcessBy = 0
+	j.CreateBy = 0
+	j.Percent, j.Denominator = 0, 0
+	if front {
+		s.getJobWorkPair(j.FuncName).jobs.PushFront(j)
+	} else {
+		s.add2JobWorkerQueue(j)
+	}
+	s.jobs[j.Handle] = j
+	if len(j.Id) > 0 {
+		key := uniqueKey(j.FuncName, j.Id)
+		if _, ok := s.uniqueJobs[key]; !ok {
+			s.uniqueJobs[key] = j
+		}
+	}
+	s.saveJobInDB(j)
+}
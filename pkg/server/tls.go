@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/appscode/go/log"
+)
+
+// how often the certificate files are checked for changes, at most
+const certCheckInterval = time.Second
+
+// certReloader holds the server certificate and the CAs client certificates
+// are verified against, and reloads them when their files change. It is
+// shared by the Gearman listener and the web server, not owned by the event
+// loop.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool //nil when client certificates are not verified
+	modTimes []time.Time    //of certFile, keyFile and caFile at the last load
+	checked  time.Time
+}
+
+// newCertReloader loads the certificate, the key and, when caFile is not
+// empty, the client CAs.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if len(r.caFile) > 0 {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+func (r *certReloader) statFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, name := range r.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the files, keeping the loaded ones if any is invalid.
+func (r *certReloader) load() error {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCA *x509.CertPool
+	if len(r.caFile) > 0 {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %v", r.caFile)
+		}
+	}
+	r.cert, r.clientCA, r.modTimes = &cert, clientCA, modTimes
+	return nil
+}
+
+// reload loads the files again if any changed since the last load, checking
+// at most once per certCheckInterval. Must be called with r.mu held.
+func (r *certReloader) reload() {
+	if time.Since(r.checked) < certCheckInterval {
+		return
+	}
+	r.checked = time.Now()
+	modTimes, err := r.statFiles()
+	if err != nil {
+		log.Errorln("checking TLS certificate:", err)
+		return
+	}
+	changed := false
+	for i, t := range modTimes {
+		if !t.Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Errorln("reloading TLS certificate:", err)
+		return
+	}
+	log.Infoln("reloaded TLS certificate", r.certFile)
+}
+
+// config returns the TLS settings for a new connection.
+func (r *certReloader) config() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reload()
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.clientCA != nil {
+		cfg.ClientCAs = r.clientCA
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// tlsConfig returns the TLS settings of a listener, picking up certificate
+// changes on every handshake.
+func (r *certReloader) tlsConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := r.config()
+			cfg.NextProtos = nextProtos
+			return cfg, nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := r.config().Certificates[0]
+			return &cert, nil
+		},
+	}
+}
+
+// listen opens the Gearman port, with TLS when a certificate is configured.
+func (s *Server) listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil || s.certs == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, s.certs.tlsConfig()), nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drawks/gearhulk/client"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	"github.com/drawks/gearhulk/worker"
+)
+
+// testCert is a generated certificate, written to certFile and keyFile.
+type testCert struct {
+	cert              *x509.Certificate
+	key               *ecdsa.PrivateKey
+	certFile, keyFile string
+}
+
+// genCert generates a certificate for 127.0.0.1 signed by parent, or a self
+// signed CA when parent is nil.
+func genCert(t *testing.T, name string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(t.TempDir(), name+".crt"),
+		keyFile:  filepath.Join(t.TempDir(), name+".key"),
+	}
+	writePEM(t, tc.certFile, "CERTIFICATE", der)
+	writePEM(t, tc.keyFile, "EC PRIVATE KEY", keyDer)
+	return tc
+}
+
+func writePEM(t *testing.T, name, tp string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: tp, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientTLS returns the TLS settings of a client trusting ca, presenting
+// cert unless it is nil.
+func clientTLS(ca, cert *testCert) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{{
+			Certificate: [][]byte{cert.cert.Raw},
+			PrivateKey:  cert.key,
+		}}
+	}
+	return cfg
+}
+
+// listenTLS starts serving the Gearman protocol over TLS on a free port.
+func listenTLS(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	s := newTestServerWithConfig(t, cfg)
+	certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.certs = certs
+	return s, listenTest(t, s)
+}
+
+func TestTLS(t *testing.T) {
+	ca := genCert(t, "ca", 1, nil)
+	srvCert := genCert(t, "server", 2, ca)
+	cliCert := genCert(t, "client", 3, ca)
+	_, addr := listenTLS(t, Config{
+		TLSCertFile:     srvCert.certFile,
+		TLSKeyFile:      srvCert.keyFile,
+		TLSClientCAFile: ca.certFile,
+	})
+
+	w := worker.New(worker.OneByOne)
+	defer w.Close()
+	w.ErrorHandler = func(err error) { t.Log("worker:", err) }
+	if err := w.AddServer("tcp", addr, worker.WithTLS(clientTLS(ca, cliCert))); err != nil {
+		t.Fatal(err)
+	}
+	w.AddFunc("echo", func(job worker.Job) ([]byte, error) {
+		return job.Data(), nil
+	}, worker.Unlimited)
+	if err := w.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	go w.Work()
+
+	c, err := client.NewTLS("tcp", addr, clientTLS(ca, cliCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan []byte, 1)
+	if _, err := c.Do("echo", []byte("secret"), JobNormal, func(resp *client.Response) {
+		if resp.DataType == PT_WorkComplete {
+			done <- resp.Data
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-done:
+		if string(data) != "secret" {
+			t.Errorf("unexpected result %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not completed")
+	}
+
+	//without a client certificate the server ends the handshake
+	conn, err := tls.Dial("tcp", addr, clientTLS(ca, nil))
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(constructReply(PT_EchoReq, [][]byte{[]byte("ping")}))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Error("connection without client certificate accepted")
+		}
+	}
+
+	//nor does a plain TCP client get a Gearman reply
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	plain.Write(constructReply(PT_EchoReq, [][]byte{[]byte("ping")}))
+	if _, _, err := ReadMessage(plain); err == nil {
+		t.Error("plain TCP connection answered")
+	}
+}
+
+func TestTLSWebServer(t *testing.T) {
+	ca := genCert(t, "ca", 1, nil)
+	srvCert := genCert(t, "server", 2, ca)
+	certs, err := newCertReloader(srvCert.certFile, srvCert.keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }),
+		TLSConfig: certs.tlsConfig("h2", "http/1.1"),
+	}
+	defer web.Close()
+	go web.ServeTLS(ln, "", "")
+
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS(ca, nil)}, Timeout: 5 * time.Second}
+	resp, err := hc.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %v", resp.Status)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	ca := genCert(t, "ca", 1, nil)
+	first := genCert(t, "first", 2, ca)
+	second := genCert(t, "second", 3, ca)
+	r, err := newCertReloader(first.certFile, first.keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, err := x509.ParseCertificate(r.config().Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.SerialNumber.Int64()
+	}
+	replace := func(src, dst string, modTime time.Time) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dst, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire := func() {
+		r.mu.Lock()
+		r.checked = time.Time{}
+		r.mu.Unlock()
+	}
+
+	//a broken file keeps the loaded certificate
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(first.certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(first.certFile, later, later)
+	expire()
+	if got := serial(); got != 2 {
+		t.Errorf("serving certificate %v, want 2", got)
+	}
+
+	replace(second.certFile, first.certFile, later.Add(time.Minute))
+	replace(second.keyFile, first.keyFile, later.Add(time.Minute))
+	//changes are picked up at most once per certCheckInterval
+	if got := serial(); got != 2 {
+		t.Errorf("serving certificate %v before the check interval, want 2", got)
+	}
+	expire()
+	if got := serial(); got != 3 {
+		t.Errorf("serving certificate %v after the change, want 3", got)
+	}
+}
@@ -18,8 +18,10 @@ import (
 )
 
 var (
-	invalidMagic = errors.New("invalid magic")
-	invalidArg   = errors.New("invalid argument")
+	invalidMagic      = errors.New("invalid magic")
+	invalidArg        = errors.New("invalid argument")
+	unknownPacketType = errors.New("unknown packet type")
+	packetTooLarge    = errors.New("packet too large")
 )
 
 type AP string
@@ -37,6 +39,9 @@ const (
 	AP_Verbose         AP = "verbose"
 	AP_Version         AP = "version"
 	AP_PRIORITY_STATUS AP = "prioritystatus"
+	AP_DeadLetter      AP = "deadletter"
+	AP_Snapshot        AP = "snapshot"
+	AP_Drain           AP = "drain"
 )
 
 const (
@@ -44,6 +49,39 @@ const (
 	ctrlGetJob
 	ctrlGetWorker
 	ctrlGetCronJob
+	ctrlGetFunction
+	ctrlRequeueJob
+	ctrlGetDeadJob
+	ctrlRequeueDeadJob
+	ctrlPurgeDeadJob
+	ctrlDrain
+	ctrlShutdown
+	ctrlShowJobs
+	ctrlShowUniqueJobs
+	ctrlCreateFunction
+	ctrlDropFunction
+	ctrlMaxQueue
+	ctrlSnapshot
+	ctrlRestore
+	ctrlStats
+	ctrlRunCronJob
+	ctrlRunEpochJob
+	ctrlCancelCronJob
+	ctrlStatus
+	ctrlPriorityStatus
+	ctrlWorkers
+	ctrlLogJobs
+)
+
+// job outcomes counted per function
+const (
+	outcomeCompleted = "completed"
+	outcomeFailed    = "failed"
+	outcomeException = "exception"
+	outcomeRetried   = "retried"
+	outcomeExhausted = "exhausted"
+	outcomeRequeued  = "requeued"
+	outcomeRejected  = "rejected"
 )
 
 var (
@@ -94,6 +132,11 @@ func IsValidCronJobHandle(handle string) bool {
 	return strings.HasPrefix(handle, runtime.CronJobPrefix)
 }
 
+// uniqueKey identifies a job by its function name and client supplied unique id.
+func uniqueKey(funcName, unique string) string {
+	return funcName + "\x00" + unique
+}
+
 type event struct {
 	tp            runtime.PT
 	args          *Tuple
@@ -104,7 +147,7 @@ type event struct {
 
 type jobworkermap struct {
 	workers *list.List
-	jobs    *list.List
+	jobs    *jobQueue
 }
 
 type Tuple struct {
@@ -168,9 +211,39 @@ func sendTextError(out chan []byte, errmsg string) {
 	out <- []byte(fmt.Sprintf("Error: %s\n", errmsg))
 }
 
-func sendTimeoutException(out chan []byte, handle string, exception string) {
+// codedError is a request failure reported to the client with an ERROR packet.
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.code + ": " + e.msg
+}
+
+func errorReply(err *codedError) []byte {
+	return constructReply(runtime.PT_Error, [][]byte{[]byte(err.code), []byte(err.msg)})
+}
+
+func timeoutException(handle string, exception string) []byte {
 	data := [][]byte{[]byte(handle), []byte(exception)}
-	out <- constructReply(runtime.PT_WorkException, data)
+	return constructReply(runtime.PT_WorkException, data)
+}
+
+// jobAssignReply builds the JOB_ASSIGN variant answering a grab request:
+// GRAB_JOB gets JOB_ASSIGN, GRAB_JOB_UNIQ gets JOB_ASSIGN_UNIQ and
+// GRAB_JOB_ALL gets JOB_ASSIGN_ALL.
+func jobAssignReply(grab runtime.PT, j *runtime.Job) []byte {
+	switch grab {
+	case runtime.PT_GrabJob:
+		return constructReply(runtime.PT_JobAssign, [][]byte{
+			[]byte(j.Handle), []byte(j.FuncName), j.Data})
+	case runtime.PT_GrabJobAll:
+		return constructReply(runtime.PT_JobAssignAll, [][]byte{
+			[]byte(j.Handle), []byte(j.FuncName), []byte(j.Id), []byte(j.Reducer), j.Data})
+	}
+	return constructReply(runtime.PT_JobAssignUniq, [][]byte{
+		[]byte(j.Handle), []byte(j.FuncName), []byte(j.Id), j.Data})
 }
 
 func constructReply(tp runtime.PT, data [][]byte) []byte {
@@ -229,8 +302,25 @@ func int2bytes(n interface{}) []byte {
 	return []byte(strconv.Itoa(n.(int)))
 }
 
+// ReadMessage reads a packet of the binary protocol. The body of a packet of
+// an unknown type is skipped, its error is unknownPacketType and the next
+// packet can be read. Packets with more than DefaultMaxPacketSize bytes of
+// data are not read, their error is packetTooLarge.
 func ReadMessage(r io.Reader) (runtime.PT, []byte, error) {
+	return readMessage(r, runtime.DefaultMaxPacketSize)
+}
+
+func readMessage(r io.Reader, maxSize int) (runtime.PT, []byte, error) {
 	_, tp, size, err := readHeader(r)
+	if (err == nil || err == unknownPacketType) && int64(size) > int64(maxSize) {
+		return tp, nil, packetTooLarge
+	}
+	if err == unknownPacketType {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return tp, nil, err
+		}
+		return tp, nil, unknownPacketType
+	}
 	if err != nil {
 		return tp, nil, err
 	}
@@ -269,9 +359,13 @@ func readHeader(r io.Reader) (magic uint32, tp runtime.PT, size uint32, err erro
 	}
 	tp, err = runtime.NewPT(cmd)
 	if err != nil {
-		return
+		log.Debug(err)
+		err = unknownPacketType
+	}
+	var sizeErr error
+	if size, sizeErr = readUint32(r); sizeErr != nil {
+		err = sizeErr
 	}
-	size, err = readUint32(r)
 	return
 }
 
@@ -324,7 +418,7 @@ func readUint32(r io.Reader) (uint32, error) {
 }
 
 func validProtocolDef() {
-	if runtime.PT_CanDo != 1 || runtime.PT_SubmitJobEpoch != 36 { //protocol check
+	if runtime.PT_CanDo != 1 || runtime.PT_SubmitJobEpoch != 36 || runtime.PT_StatusResUnique != 42 { //protocol check
 		panic("protocol define not match")
 	}
 }
@@ -370,14 +464,17 @@ func LocalIP() (net.IP, error) {
 func cmd2Priority(cmd runtime.PT) int {
 	switch cmd {
 	case runtime.PT_SubmitJobHigh, runtime.PT_SubmitJobHighBG:
-		return runtime.PRIORITY_HIGH
+		return runtime.JobHigh
+	case runtime.PT_SubmitJobLow, runtime.PT_SubmitJobLowBG:
+		return runtime.JobLow
 	}
-	return runtime.PRIORITY_LOW
+	return runtime.JobNormal
 }
 
 func isBackGround(cmd runtime.PT) bool {
 	switch cmd {
-	case runtime.PT_SubmitJobLowBG, runtime.PT_SubmitJobBG, runtime.PT_SubmitJobHighBG:
+	case runtime.PT_SubmitJobLowBG, runtime.PT_SubmitJobBG, runtime.PT_SubmitJobHighBG,
+		runtime.PT_SubmitReduceJobBackground:
 		return true
 	}
 	return false
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"net"
+	"sort"
+	"sync/atomic"
 
 	. "github.com/drawks/gearhulk/pkg/runtime"
 )
@@ -35,6 +37,37 @@ type Worker struct {
 	status      int
 	runningJobs map[string]*Job
 	canDo       map[string]int32
+	lastFunc    string //function the last job was popped from
+	allYours    bool   //sent ALL_YOURS, it is connected to no other server
+	asleep      bool   //sent PRE_SLEEP and wasn't woken up with a NOOP yet
+	busy        int32  //1 while it runs jobs or is asleep, the session reads it atomically
+}
+
+// setBusy publishes whether the worker waits for the server, either for its
+// running jobs to end or for a NOOP. Otherwise its session may time out.
+func (w *Worker) setBusy() {
+	var busy int32
+	if w.asleep || len(w.runningJobs) > 0 {
+		busy = 1
+	}
+	atomic.StoreInt32(&w.busy, busy)
+}
+
+// canDoFrom returns the functions this worker can do in name order, starting
+// with the first function sorting after `last`.
+func (w *Worker) canDoFrom(last string) []string {
+	funcs := make([]string, 0, len(w.canDo))
+	for funcName := range w.canDo {
+		funcs = append(funcs, funcName)
+	}
+	sort.Strings(funcs)
+	i := sort.SearchStrings(funcs, last)
+	if i < len(funcs) && funcs[i] == last {
+		i++
+	}
+	ordered := make([]string, 0, len(funcs))
+	ordered = append(ordered, funcs[i:]...)
+	return append(ordered, funcs[:i]...)
 }
 
 func (w *Worker) MarshalJSON() ([]byte, error) {
@@ -44,6 +77,7 @@ func (w *Worker) MarshalJSON() ([]byte, error) {
 	m["sessionId"] = w.SessionId
 	m["Id"] = w.workerId
 	m["status"] = status2str(w.status)
+	m["allYours"] = w.allYours
 
 	type FuncWithDuration struct {
 		FunctionName string `json:"function_name,omitempty"`
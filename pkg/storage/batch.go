@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Durability selects when writes reach the disk.
+type Durability string
+
+const (
+	// DurabilityNone writes batches in the background without syncing them,
+	// a crash of the machine may lose what the OS didn't write yet.
+	DurabilityNone Durability = "none"
+	// DurabilityBatched writes and syncs batches in the background, a crash
+	// loses at most the writes of the last flush interval.
+	DurabilityBatched Durability = "batched"
+	// DurabilityEveryWrite writes and syncs every change before returning.
+	DurabilityEveryWrite Durability = "every-write"
+)
+
+const (
+	DefaultFlushInterval = 10 * time.Millisecond
+	DefaultMaxBatch      = 1000
+)
+
+// ParseDurability checks a durability mode given as a string.
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case DurabilityNone, DurabilityBatched, DurabilityEveryWrite:
+		return d, nil
+	}
+	return "", fmt.Errorf("storage: unknown durability %q, use %v, %v or %v",
+		s, DurabilityNone, DurabilityBatched, DurabilityEveryWrite)
+}
+
+// Op is a change of a batch with the encoded added or deleted item.
+type Op struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// BatchWriter is implemented by backends which write several changes at
+// once. Backends without it get the changes one by one.
+type BatchWriter interface {
+	WriteBatch(ops []Op, sync bool) error
+}
+
+// BatchOptions configures NewBatched.
+type BatchOptions struct {
+	Durability    Durability
+	FlushInterval time.Duration // how long changes wait for the next group commit
+	MaxBatch      int           // pending changes which trigger a flush right away
+	ErrorHandler  func(error)   // called when a background flush fails, may be nil
+}
+
+// Batched is a Db which encodes changes when they are made and writes them
+// to the underlying Db in group commits from its own goroutine, so callers
+// don't wait for the disk. Changes of the same key within a flush interval
+// are coalesced, only the last one is written. Reads see pending changes.
+// The changes of a failed flush stay pending and are written again by the
+// next one.
+type Batched struct {
+	db   Db
+	opts BatchOptions
+
+	flushMu sync.Mutex //held while a batch is written, keeps batches in order
+	mu      sync.Mutex
+	pending []Op
+	index   map[string]int //key -> position in pending
+
+	kick    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+var _ Db = &Batched{}
+
+// NewBatched wraps db. With DurabilityEveryWrite changes are written
+// synchronously, in the other modes by a flusher goroutine stopped by Close.
+func NewBatched(db Db, opts BatchOptions) *Batched {
+	if len(opts.Durability) == 0 {
+		opts.Durability = DurabilityBatched
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = DefaultMaxBatch
+	}
+	b := &Batched{
+		db:      db,
+		opts:    opts,
+		index:   make(map[string]int),
+		kick:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts.Durability == DurabilityEveryWrite {
+		close(b.done)
+	} else {
+		go b.flushLoop()
+	}
+	return b
+}
+
+func (b *Batched) Add(item DbItem) error {
+	buf, err := Encode(item)
+	if err != nil {
+		return err
+	}
+	return b.write(Op{Key: item.Key(), Value: buf})
+}
+
+func (b *Batched) Delete(item DbItem) error {
+	buf, err := Encode(item)
+	if err != nil {
+		return err
+	}
+	return b.write(Op{Key: item.Key(), Value: buf, Delete: true})
+}
+
+func (b *Batched) write(op Op) error {
+	if b.opts.Durability == DurabilityEveryWrite {
+		return writeBatch(b.db, []Op{op}, true)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue(op)
+	if len(b.pending) >= b.opts.MaxBatch {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// queue adds op to the pending changes, replacing a pending change of the
+// same key. Must be called with b.mu held.
+func (b *Batched) queue(op Op) {
+	if i, ok := b.index[op.Key]; ok {
+		b.pending[i] = op
+	} else {
+		b.index[op.Key] = len(b.pending)
+		b.pending = append(b.pending, op)
+	}
+}
+
+func (b *Batched) Get(t DbItem) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	i, ok := b.index[t.Key()]
+	var op Op
+	if ok {
+		op = b.pending[i]
+	}
+	b.mu.Unlock()
+	if !ok {
+		return b.db.Get(t)
+	}
+	if op.Delete {
+		return ErrNotFound
+	}
+	return Decode(op.Value, t)
+}
+
+// GetAll flushes the pending changes and reads from the underlying Db.
+func (b *Batched) GetAll(t DbItem) ([]DbItem, error) {
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return b.db.GetAll(t)
+}
+
+// Flush writes the pending changes now. When that fails they stay pending.
+func (b *Batched) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	ops := b.pending
+	b.pending = nil
+	b.index = make(map[string]int)
+	b.mu.Unlock()
+	if len(ops) == 0 {
+		return nil
+	}
+	err := writeBatch(b.db, ops, b.opts.Durability != DurabilityNone)
+	if err != nil {
+		b.requeue(ops)
+	}
+	return err
+}
+
+// requeue puts the changes of a failed batch back in front of the changes
+// made while it was written, which replace them. Writing a change again is
+// harmless when a backend without BatchWriter applied part of the batch.
+func (b *Batched) requeue(ops []Op) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	newer := b.pending
+	b.pending = nil
+	b.index = make(map[string]int)
+	for _, op := range ops {
+		b.queue(op)
+	}
+	for _, op := range newer {
+		b.queue(op)
+	}
+}
+
+func (b *Batched) flushLoop() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.kick:
+		case <-b.closing:
+			return
+		}
+		if err := b.Flush(); err != nil && b.opts.ErrorHandler != nil {
+			b.opts.ErrorHandler(err)
+		}
+	}
+}
+
+// Close stops the flusher, writes the pending changes and closes the
+// underlying Db.
+func (b *Batched) Close() error {
+	select {
+	case <-b.closing:
+	default:
+		close(b.closing)
+	}
+	<-b.done
+	err := b.Flush()
+	if cerr := b.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeBatch(db Db, ops []Op, sync bool) error {
+	if w, ok := db.(BatchWriter); ok {
+		return w.WriteBatch(ops, sync)
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = db.Delete(encodedItem{op})
+		} else {
+			err = db.Add(encodedItem{op})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodedItem hands an encoded change to a backend without BatchWriter.
+type encodedItem struct {
+	op Op
+}
+
+func (e encodedItem) Key() string    { return e.op.Key }
+func (e encodedItem) Prefix() string { return "" }
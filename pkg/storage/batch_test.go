@@ -0,0 +1,253 @@
+package storage_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	. "github.com/drawks/gearhulk/pkg/storage"
+	"github.com/drawks/gearhulk/pkg/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDb counts the changes reaching a memory Db and fails them while
+// err is set, or only the failAt'th change when failAt is set.
+type countingDb struct {
+	Db
+	mu       sync.Mutex
+	writes   int
+	attempts int
+	failAt   int
+	err      error
+}
+
+func (c *countingDb) fail() error {
+	c.attempts++
+	if c.attempts == c.failAt {
+		return errors.New("disk full")
+	}
+	return c.err
+}
+
+func (c *countingDb) Add(item DbItem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.fail(); err != nil {
+		return err
+	}
+	c.writes++
+	return c.Db.Add(item)
+}
+
+func (c *countingDb) Delete(item DbItem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.fail(); err != nil {
+		return err
+	}
+	c.writes++
+	return c.Db.Delete(item)
+}
+
+func (c *countingDb) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+func TestBatchedReadsPendingChanges(t *testing.T) {
+	db := &countingDb{Db: memory.New()}
+	b := NewBatched(db, BatchOptions{FlushInterval: time.Hour})
+	defer b.Close()
+
+	j := testJobs[2]
+	testAdd(t, b, j)
+	jn := &Job{Handle: j.Handle}
+	testGet(t, b, jn)
+	assert.Equal(t, j, jn)
+	assert.Equal(t, 0, db.count())
+
+	testDelete(t, b, j)
+	assert.Equal(t, ErrNotFound, b.Get(&Job{Handle: j.Handle}))
+
+	//GetAll writes the pending changes first
+	testAdd(t, b, testJobs[3])
+	assert.Len(t, testGetAll(t, b, &Job{}), 1)
+	assert.Equal(t, 2, db.count())
+}
+
+func TestBatchedCoalescesChanges(t *testing.T) {
+	db := &countingDb{Db: memory.New()}
+	b := NewBatched(db, BatchOptions{FlushInterval: time.Hour})
+	defer b.Close()
+
+	j := &Job{Handle: JobPrefix + "short-lived"}
+	for i := 0; i < 10; i++ {
+		j.Attempts = i
+		testAdd(t, b, j)
+	}
+	testDelete(t, b, j)
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, 1, db.count())
+	assert.Equal(t, ErrNotFound, db.Get(&Job{Handle: j.Handle}))
+}
+
+func TestBatchedFlushes(t *testing.T) {
+	//by interval
+	db := &countingDb{Db: memory.New()}
+	b := NewBatched(db, BatchOptions{FlushInterval: time.Millisecond})
+	testAdd(t, b, testJobs[0])
+	waitFor(t, func() bool { return db.count() == 1 })
+	b.Close()
+
+	//by batch size
+	db = &countingDb{Db: memory.New()}
+	b = NewBatched(db, BatchOptions{FlushInterval: time.Hour, MaxBatch: 3})
+	for _, j := range testJobs[:3] {
+		testAdd(t, b, j)
+	}
+	waitFor(t, func() bool { return db.count() == 3 })
+	b.Close()
+
+	//every write
+	db = &countingDb{Db: memory.New()}
+	b = NewBatched(db, BatchOptions{Durability: DurabilityEveryWrite})
+	testAdd(t, b, testJobs[0])
+	assert.Equal(t, 1, db.count())
+	b.Close()
+}
+
+func TestBatchedCloseFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "g2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []Durability{DurabilityNone, DurabilityBatched} {
+		b := NewBatched(openTestDb(t, dir), BatchOptions{Durability: d, FlushInterval: time.Hour})
+		j := &Job{Handle: JobPrefix + string(d), FuncName: "f"}
+		testAdd(t, b, j)
+		assert.NoError(t, b.Close())
+
+		db := openTestDb(t, dir)
+		jn := &Job{Handle: j.Handle}
+		testGet(t, db, jn)
+		assert.Equal(t, j, jn)
+		db.Close()
+	}
+}
+
+func TestBatchedRetriesFailedFlushes(t *testing.T) {
+	//the second change of the batch fails once, after the first was written
+	db := &countingDb{Db: memory.New(), failAt: 2}
+	b := NewBatched(db, BatchOptions{FlushInterval: time.Hour})
+	defer b.Close()
+
+	gone := &Job{Handle: JobPrefix + "gone", FuncName: "f"}
+	assert.NoError(t, db.Db.Add(gone))
+	jobs := []*Job{
+		{Handle: JobPrefix + "j1", FuncName: "f"},
+		{Handle: JobPrefix + "j2", FuncName: "f"},
+		{Handle: JobPrefix + "j3", FuncName: "f"},
+	}
+	for _, j := range jobs {
+		testAdd(t, b, j)
+	}
+	testDelete(t, b, gone)
+	assert.Error(t, b.Flush())
+
+	//the failed changes are still pending, a newer change replaces one
+	jn := &Job{Handle: jobs[1].Handle}
+	testGet(t, b, jn)
+	assert.Equal(t, jobs[1], jn)
+	assert.Equal(t, ErrNotFound, b.Get(&Job{Handle: gone.Handle}))
+	updated := &Job{Handle: jobs[1].Handle, FuncName: "f", Attempts: 1}
+	testAdd(t, b, updated)
+
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, []DbItem{jobs[0], updated, jobs[2]}, testGetAll(t, db.Db, &Job{}))
+	//the first change is written again, the others once
+	assert.Equal(t, 5, db.count())
+}
+
+func TestBatchedRetriesInBackground(t *testing.T) {
+	db := &countingDb{Db: memory.New(), failAt: 1}
+	errs := make(chan error, 1)
+	b := NewBatched(db, BatchOptions{FlushInterval: time.Millisecond, ErrorHandler: func(err error) {
+		errs <- err
+	}})
+	defer b.Close()
+
+	//writers don't get errors of background flushes
+	testAdd(t, b, testJobs[0])
+	assert.Error(t, <-errs)
+	testAdd(t, b, testJobs[1])
+	waitFor(t, func() bool { return db.count() == 2 })
+	assert.Len(t, testGetAll(t, db.Db, &Job{}), 2)
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, s := range []string{"none", "batched", "every-write"} {
+		d, err := ParseDurability(s)
+		assert.NoError(t, err)
+		assert.Equal(t, Durability(s), d)
+	}
+	_, err := ParseDurability("fsync")
+	assert.Error(t, err)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkDurability submits and finishes jobs the way the event loop does,
+// on LevelDB without batching and with each durability mode.
+func BenchmarkDurability(b *testing.B) {
+	modes := []Durability{"", DurabilityNone, DurabilityBatched, DurabilityEveryWrite}
+	for _, d := range modes {
+		name := string(d)
+		if len(name) == 0 {
+			name = "unbatched"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "g2")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			db := openTestDb(b, dir)
+			if len(d) > 0 {
+				db = NewBatched(db, BatchOptions{Durability: d})
+			}
+			defer db.Close()
+
+			jobs := make([]*Job, 100)
+			for i := range jobs {
+				jobs[i] = &Job{Handle: JobPrefix + strconv.Itoa(i), FuncName: "bench",
+					Data: make([]byte, 256), CreateAt: time.Now()}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				//submit, grab and finish
+				j := jobs[i%len(jobs)]
+				j.Running = false
+				db.Add(j)
+				j.Running = true
+				db.Add(j)
+				db.Delete(j)
+			}
+		})
+	}
+}
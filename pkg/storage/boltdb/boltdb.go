@@ -0,0 +1,127 @@
+package boltdb
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/drawks/gearhulk/pkg/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("gearhulk")
+
+type BoltDb struct {
+	db *bolt.DB
+}
+
+var _ storage.Db = &BoltDb{}
+var _ storage.BatchWriter = &BoltDb{}
+var _ storage.Scanner = &BoltDb{}
+
+func init() {
+	storage.Register("bolt", func(u *url.URL) (storage.Db, error) {
+		return New(storage.Path(u))
+	})
+}
+
+func New(path string) (storage.Db, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDb{db: db}, nil
+}
+
+func (q *BoltDb) Add(item storage.DbItem) error {
+	buf, err := storage.Encode(item)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(item.Key()), buf)
+	})
+}
+
+func (q *BoltDb) Delete(item storage.DbItem) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(item.Key()))
+	})
+}
+
+// WriteBatch writes the changes in one transaction. bbolt syncs every
+// transaction, unless sync is off.
+func (q *BoltDb) WriteBatch(ops []storage.Op, sync bool) error {
+	q.db.NoSync = !sync
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for _, op := range ops {
+			var err error
+			if op.Delete {
+				err = b.Delete([]byte(op.Key))
+			} else {
+				err = b.Put([]byte(op.Key), op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (q *BoltDb) Get(t storage.DbItem) error {
+	return q.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(t.Key()))
+		if data == nil {
+			return storage.ErrNotFound
+		}
+		return storage.Decode(data, t)
+	})
+}
+
+func (q *BoltDb) GetAll(t storage.DbItem) ([]storage.DbItem, error) {
+	items := make([]storage.DbItem, 0)
+	prefix := []byte(t.Prefix())
+	err := q.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			obj := reflect.New(reflect.TypeOf(t).Elem()).Interface().(storage.DbItem)
+			if err := storage.Decode(v, obj); err != nil {
+				return err
+			}
+			items = append(items, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (q *BoltDb) Scan(prefix string, fn func(key string, value []byte) error) error {
+	p := []byte(prefix)
+	return q.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (q *BoltDb) Close() error {
+	return q.db.Close()
+}
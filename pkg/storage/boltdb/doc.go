@@ -0,0 +1,3 @@
+// Package boltdb is a storage backend keeping items in a single bbolt file,
+// opened with URIs like bolt:///var/lib/gearhulk/gearhulk.db.
+package boltdb
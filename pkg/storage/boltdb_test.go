@@ -0,0 +1,10 @@
+package storage_test
+
+import (
+	_ "github.com/drawks/gearhulk/pkg/storage/boltdb"
+)
+
+func init() {
+	testBackends["bolt"] = func(dir string) string { return "bolt://" + dir + "/gearhulk.db" }
+	persistent["bolt"] = true
+}
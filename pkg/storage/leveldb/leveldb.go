@@ -3,12 +3,13 @@
 package leveldbq
 
 import (
-	"encoding/json"
+	"net/url"
 	"reflect"
 	"strings"
 
 	"github.com/drawks/gearhulk/pkg/storage"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -17,6 +18,15 @@ type LevelDbQ struct {
 }
 
 var _ storage.Db = &LevelDbQ{}
+var _ storage.BatchWriter = &LevelDbQ{}
+var _ storage.Scanner = &LevelDbQ{}
+var _ storage.Compacter = &LevelDbQ{}
+
+func init() {
+	storage.Register("leveldb", func(u *url.URL) (storage.Db, error) {
+		return New(storage.Path(u))
+	})
+}
 
 func New(dir string) (storage.Db, error) {
 	db, err := leveldb.OpenFile(strings.TrimRight(dir, "/")+"/gearmand.ldb", nil)
@@ -27,7 +37,7 @@ func New(dir string) (storage.Db, error) {
 }
 
 func (q *LevelDbQ) Add(item storage.DbItem) error {
-	buf, err := json.Marshal(item)
+	buf, err := storage.Encode(item)
 	if err != nil {
 		return err
 	}
@@ -38,27 +48,52 @@ func (q *LevelDbQ) Delete(item storage.DbItem) error {
 	return q.db.Delete([]byte(item.Key()), nil)
 }
 
+// WriteBatch writes the changes atomically, synced to disk if sync is set.
+func (q *LevelDbQ) WriteBatch(ops []storage.Op, sync bool) error {
+	batch := new(leveldb.Batch)
+	for _, op := range ops {
+		if op.Delete {
+			batch.Delete([]byte(op.Key))
+		} else {
+			batch.Put([]byte(op.Key), op.Value)
+		}
+	}
+	return q.db.Write(batch, &opt.WriteOptions{Sync: sync})
+}
+
 func (q *LevelDbQ) Get(t storage.DbItem) error {
 	data, err := q.db.Get([]byte(t.Key()), nil)
+	if err == leveldb.ErrNotFound {
+		return storage.ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(data, t)
+	err = storage.Decode(data, t)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetAll returns the items with the prefix of t. Items still stored as
+// JSON by earlier versions are rewritten as binary records.
 func (q *LevelDbQ) GetAll(t storage.DbItem) ([]storage.DbItem, error) {
 	items := make([]storage.DbItem, 0)
+	migrated := new(leveldb.Batch)
 	iter := q.db.NewIterator(util.BytesPrefix([]byte(t.Prefix())), nil)
 	for iter.Next() {
 		obj := reflect.New(reflect.TypeOf(t).Elem()).Interface().(storage.DbItem)
-		err := json.Unmarshal(iter.Value(), &obj)
+		err := storage.Decode(iter.Value(), obj)
 		if err != nil {
+			iter.Release()
 			return nil, err
 		}
+		if !storage.IsRecord(iter.Value()) {
+			if buf, err := storage.Encode(obj); err == nil && storage.IsRecord(buf) {
+				migrated.Put(append([]byte(nil), iter.Key()...), buf)
+			}
+		}
 		items = append(items, obj)
 	}
 	iter.Release()
@@ -66,5 +101,29 @@ func (q *LevelDbQ) GetAll(t storage.DbItem) ([]storage.DbItem, error) {
 	if err != nil {
 		return nil, err
 	}
+	if migrated.Len() > 0 {
+		if err := q.db.Write(migrated, nil); err != nil {
+			return nil, err
+		}
+	}
 	return items, nil
 }
+
+func (q *LevelDbQ) Scan(prefix string, fn func(key string, value []byte) error) error {
+	iter := q.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := fn(string(iter.Key()), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (q *LevelDbQ) Compact() error {
+	return q.db.CompactRange(util.Range{})
+}
+
+func (q *LevelDbQ) Close() error {
+	return q.db.Close()
+}
@@ -0,0 +1,114 @@
+// Package memory is a storage backend keeping items in memory, for tests
+// and servers which don't need to persist jobs.
+package memory
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/drawks/gearhulk/pkg/storage"
+)
+
+// MemoryDb stores items encoded, like the persistent backends, so
+// callers never share state with the store.
+type MemoryDb struct {
+	mu    sync.RWMutex
+	items map[string][]byte
+}
+
+var _ storage.Db = &MemoryDb{}
+var _ storage.Scanner = &MemoryDb{}
+
+func init() {
+	storage.Register("memory", func(u *url.URL) (storage.Db, error) {
+		return New(), nil
+	})
+}
+
+func New() storage.Db {
+	return &MemoryDb{items: make(map[string][]byte)}
+}
+
+func (q *MemoryDb) Add(item storage.DbItem) error {
+	buf, err := storage.Encode(item)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.items[item.Key()] = buf
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *MemoryDb) Delete(item storage.DbItem) error {
+	q.mu.Lock()
+	delete(q.items, item.Key())
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *MemoryDb) Get(t storage.DbItem) error {
+	q.mu.RLock()
+	data, ok := q.items[t.Key()]
+	q.mu.RUnlock()
+	if !ok {
+		return storage.ErrNotFound
+	}
+	return storage.Decode(data, t)
+}
+
+// GetAll returns the items with the prefix of t ordered by key.
+func (q *MemoryDb) GetAll(t storage.DbItem) ([]storage.DbItem, error) {
+	q.mu.RLock()
+	keys := make([]string, 0)
+	for key := range q.items {
+		if strings.HasPrefix(key, t.Prefix()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = q.items[key]
+	}
+	q.mu.RUnlock()
+
+	items := make([]storage.DbItem, 0, len(values))
+	for _, v := range values {
+		obj := reflect.New(reflect.TypeOf(t).Elem()).Interface().(storage.DbItem)
+		if err := storage.Decode(v, obj); err != nil {
+			return nil, err
+		}
+		items = append(items, obj)
+	}
+	return items, nil
+}
+
+func (q *MemoryDb) Scan(prefix string, fn func(key string, value []byte) error) error {
+	q.mu.RLock()
+	keys := make([]string, 0)
+	for key := range q.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		values[key] = q.items[key]
+	}
+	q.mu.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *MemoryDb) Close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/drawks/gearhulk/pkg/record"
+)
+
+// Items are stored as binary records:
+//
+//	recordMagic recordVersion field...
+//
+// The fields are encoded by package record. The version changes only with
+// the layout itself. Records written before this format are JSON, they are
+// decoded as such.
+const (
+	recordMagic   = 0xB7 //never the first byte of JSON
+	RecordVersion = 1
+)
+
+var errTruncated = errors.New("storage: truncated record")
+
+// Encode returns the stored form of an item, a binary record if it has a
+// record encoding and JSON otherwise.
+func Encode(item DbItem) ([]byte, error) {
+	switch t := item.(type) {
+	case encodedItem:
+		return t.op.Value, nil
+	case record.Marshaler:
+		return record.Append([]byte{recordMagic, RecordVersion}, t), nil
+	}
+	return json.Marshal(item)
+}
+
+// Decode reads a stored item, a binary record or a JSON record written by
+// earlier versions.
+func Decode(data []byte, item DbItem) error {
+	if !IsRecord(data) {
+		return json.Unmarshal(data, item)
+	}
+	if len(data) < 2 {
+		return errTruncated
+	}
+	if data[1] > RecordVersion {
+		return fmt.Errorf("storage: record version %v is newer than %v", data[1], RecordVersion)
+	}
+	u, ok := item.(record.Unmarshaler)
+	if !ok {
+		return fmt.Errorf("storage: %T can't decode binary records", item)
+	}
+	return record.Unmarshal(data[2:], u)
+}
+
+// IsRecord tells binary records from the JSON of earlier versions.
+func IsRecord(data []byte) bool {
+	return len(data) > 0 && data[0] == recordMagic
+}
@@ -0,0 +1,128 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/drawks/gearhulk/pkg/record"
+	. "github.com/drawks/gearhulk/pkg/runtime"
+	. "github.com/drawks/gearhulk/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var testDeadJob = &DeadJob{Job: *testJobs[2], Reason: "exception", Exception: "boom",
+	FailedAt: time.Now().UTC()}
+
+func testItems() []DbItem {
+	items := []DbItem{testDeadJob}
+	for _, j := range testJobs {
+		items = append(items, j)
+	}
+	for _, cj := range testCronJobs {
+		items = append(items, cj)
+	}
+	return items
+}
+
+func newItem(item DbItem) DbItem {
+	switch item.(type) {
+	case *Job:
+		return &Job{}
+	case *CronJob:
+		return &CronJob{}
+	}
+	return &DeadJob{}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	for _, item := range testItems() {
+		buf, err := Encode(item)
+		assert.NoError(t, err)
+		assert.True(t, IsRecord(buf))
+		decoded := newItem(item)
+		assert.NoError(t, Decode(buf, decoded))
+		assert.Equal(t, item, decoded)
+	}
+}
+
+func TestDecodeJSONRecords(t *testing.T) {
+	for _, item := range testItems() {
+		buf, err := json.Marshal(item)
+		assert.NoError(t, err)
+		assert.False(t, IsRecord(buf))
+		decoded := newItem(item)
+		assert.NoError(t, Decode(buf, decoded))
+		assert.Equal(t, item, decoded)
+	}
+}
+
+func TestRecordIsCompact(t *testing.T) {
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	j := &Job{Handle: JobPrefix + "big", FuncName: "upload", Data: data,
+		CreateAt: time.Now().UTC(), IsBackGround: true}
+	record, _ := Encode(j)
+	legacy, _ := json.Marshal(j)
+	if len(record) > len(data)+100 || len(record)*4 > len(legacy)*3 {
+		t.Errorf("record of %v bytes for %v bytes of data, JSON has %v", len(record), len(data), len(legacy))
+	}
+}
+
+// futureJob writes a job record as a later version would, with a field this
+// version doesn't know.
+type futureJob struct{ Job }
+
+func (f *futureJob) MarshalRecord(w *record.Writer) {
+	w.String(1, f.Handle)
+	w.Bytes(1000, []byte("new field"))
+	w.Int(1001, 42)
+	w.String(12, f.FuncName)
+}
+
+func TestRecordSkipsUnknownFields(t *testing.T) {
+	buf, err := Encode(&futureJob{Job{Handle: JobPrefix + "h", FuncName: "f"}})
+	assert.NoError(t, err)
+	j := &Job{}
+	assert.NoError(t, Decode(buf, j))
+	assert.Equal(t, &Job{Handle: JobPrefix + "h", FuncName: "f"}, j)
+}
+
+func TestRecordErrors(t *testing.T) {
+	buf, _ := Encode(testJobs[0])
+
+	newer := append([]byte(nil), buf...)
+	newer[1] = RecordVersion + 1
+	assert.Error(t, Decode(newer, &Job{}))
+
+	assert.Error(t, Decode(buf[:len(buf)-1], &Job{}))
+}
+
+func TestLevelDBMigratesJSONRecords(t *testing.T) {
+	dir := t.TempDir()
+	raw, err := leveldb.OpenFile(dir+"/gearmand.ldb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, _ := json.Marshal(testJobs[0])
+	raw.Put([]byte(testJobs[0].Key()), legacy, nil)
+	raw.Close()
+
+	db := openTestDb(t, dir)
+	jobs := testGetAll(t, db, &Job{})
+	assert.Equal(t, []DbItem{testJobs[0]}, jobs)
+	db.Close()
+
+	raw, err = leveldb.OpenFile(dir+"/gearmand.ldb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	buf, err := raw.Get([]byte(testJobs[0].Key()), nil)
+	assert.NoError(t, err)
+	assert.True(t, IsRecord(buf))
+	assert.False(t, bytes.Equal(buf, legacy))
+}
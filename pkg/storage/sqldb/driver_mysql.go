@@ -0,0 +1,5 @@
+package sqldb
+
+import (
+	_ "github.com/go-sql-driver/mysql"
+)
@@ -0,0 +1,5 @@
+package sqldb
+
+import (
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,367 @@
+package sqldb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// fakeDriver is an embedded stand-in for MySQL and PostgreSQL. It keeps
+// tables in memory and understands just the statements the backend issues,
+// with ? and $n placeholders, enforcing the unique constraints of the
+// table definitions.
+type fakeDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeDb
+}
+
+func init() {
+	sql.Register("gearmanfake", &fakeDriver{dbs: make(map[string]*fakeDb)})
+}
+
+type fakeDb struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+}
+
+type fakeTable struct {
+	columns []string
+	sizes   map[string]int //of the VARCHAR columns, longer values are rejected
+	uniques [][]string
+	rows    []map[string]driver.Value
+}
+
+func (t *fakeTable) clone() *fakeTable {
+	c := &fakeTable{columns: t.columns, sizes: t.sizes, uniques: t.uniques}
+	for _, row := range t.rows {
+		r := make(map[string]driver.Value)
+		for k, v := range row {
+			r[k] = v
+		}
+		c.rows = append(c.rows, r)
+	}
+	return c
+}
+
+// Open returns a connection to the database named by dsn, all connections
+// with the same dsn share their tables.
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[dsn]
+	if !ok {
+		db = &fakeDb{tables: make(map[string]*fakeTable)}
+		d.dbs[dsn] = db
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db       *fakeDb
+	snapshot map[string]*fakeTable
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.snapshot = make(map[string]*fakeTable)
+	for name, t := range c.db.tables {
+		c.snapshot[name] = t.clone()
+	}
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.snapshot = nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.tables = c.snapshot
+	c.snapshot = nil
+	return nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+var (
+	createRe = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)$`)
+	insertRe = regexp.MustCompile(`^INSERT INTO (\w+) \(([^)]*)\) VALUES \(([^)]*)\)$`)
+	deleteRe = regexp.MustCompile(`^DELETE FROM (\w+)(?: WHERE (.*))?$`)
+	selectRe = regexp.MustCompile(`^SELECT (.*?) FROM (\w+)(?: WHERE (.*?))?(?: ORDER BY (.*))?$`)
+	uniqueRe = regexp.MustCompile(`UNIQUE \(([^)]*)\)`)
+	sizeRe   = regexp.MustCompile(`VARCHAR\((\d+)\)`)
+)
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p := &placeholders{args: args}
+	if m := createRe.FindStringSubmatch(s.query); m != nil {
+		if _, ok := db.tables[m[1]]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		t := &fakeTable{sizes: make(map[string]int)}
+		for _, u := range uniqueRe.FindAllStringSubmatch(m[2], -1) {
+			t.uniques = append(t.uniques, splitList(u[1]))
+		}
+		for _, def := range splitList(uniqueRe.ReplaceAllString(m[2], "")) {
+			if len(def) == 0 {
+				continue
+			}
+			col := strings.Fields(def)[0]
+			t.columns = append(t.columns, col)
+			if size := sizeRe.FindStringSubmatch(def); size != nil {
+				t.sizes[col], _ = strconv.Atoi(size[1])
+			}
+			if strings.HasSuffix(def, "PRIMARY KEY") {
+				t.uniques = append(t.uniques, []string{col})
+			}
+		}
+		db.tables[m[1]] = t
+		return driver.RowsAffected(0), nil
+	}
+	if m := insertRe.FindStringSubmatch(s.query); m != nil {
+		t, err := db.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]driver.Value)
+		values := splitList(m[3])
+		for i, col := range splitList(m[2]) {
+			v, err := p.value(values[i])
+			if err != nil {
+				return nil, err
+			}
+			if size, ok := t.sizes[col]; ok && utf8.RuneCountInString(str(v)) > size {
+				return nil, fmt.Errorf("data too long for column %v", col)
+			}
+			row[col] = v
+		}
+		for _, unique := range t.uniques {
+			for _, r := range t.rows {
+				if sameValues(r, row, unique) {
+					return nil, fmt.Errorf("duplicate entry for %v", unique)
+				}
+			}
+		}
+		t.rows = append(t.rows, row)
+		return driver.RowsAffected(1), nil
+	}
+	if m := deleteRe.FindStringSubmatch(s.query); m != nil {
+		t, err := db.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		match, err := p.where(m[2])
+		if err != nil {
+			return nil, err
+		}
+		kept := t.rows[:0]
+		for _, row := range t.rows {
+			if !match(row) {
+				kept = append(kept, row)
+			}
+		}
+		n := len(t.rows) - len(kept)
+		t.rows = kept
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("fakedb: unsupported statement %q", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	m := selectRe.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("fakedb: unsupported query %q", s.query)
+	}
+	t, err := db.table(m[2])
+	if err != nil {
+		return nil, err
+	}
+	p := &placeholders{args: args}
+	match, err := p.where(m[3])
+	if err != nil {
+		return nil, err
+	}
+	columns := splitList(m[1])
+	rows := &fakeRows{columns: columns}
+	for _, row := range t.rows {
+		if match(row) {
+			rows.rows = append(rows.rows, row)
+		}
+	}
+	if len(m[4]) > 0 {
+		order := splitList(m[4])
+		sort.SliceStable(rows.rows, func(a, b int) bool {
+			for _, col := range order {
+				va, vb := str(rows.rows[a][col]), str(rows.rows[b][col])
+				if va != vb {
+					return va < vb
+				}
+			}
+			return false
+		})
+	}
+	return rows, nil
+}
+
+func (db *fakeDb) table(name string) (*fakeTable, error) {
+	t, ok := db.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("fakedb: table %v doesn't exist", name)
+	}
+	return t, nil
+}
+
+// placeholders hands out the arguments of a statement, in order for ? and
+// by number for $n.
+type placeholders struct {
+	args []driver.Value
+	next int
+}
+
+func (p *placeholders) value(s string) (driver.Value, error) {
+	switch {
+	case s == "?":
+		if p.next >= len(p.args) {
+			return nil, fmt.Errorf("fakedb: missing argument %v", p.next+1)
+		}
+		p.next++
+		return p.args[p.next-1], nil
+	case strings.HasPrefix(s, "$"):
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n < 1 || n > len(p.args) {
+			return nil, fmt.Errorf("fakedb: bad placeholder %v", s)
+		}
+		return p.args[n-1], nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// where compiles conditions joined by AND, each a comparison or a
+// parenthesized OR of comparisons.
+func (p *placeholders) where(cond string) (func(row map[string]driver.Value) bool, error) {
+	match := func(map[string]driver.Value) bool { return true }
+	if len(cond) == 0 {
+		return match, nil
+	}
+	for _, term := range strings.Split(cond, " AND ") {
+		var alts []func(map[string]driver.Value) bool
+		for _, c := range strings.Split(strings.Trim(term, "()"), " OR ") {
+			f := strings.Fields(c)
+			if len(f) == 3 && f[1] == "IS" && f[2] == "NULL" {
+				col := f[0]
+				alts = append(alts, func(row map[string]driver.Value) bool { return row[col] == nil })
+				continue
+			}
+			if len(f) != 3 {
+				return nil, fmt.Errorf("fakedb: unsupported condition %q", c)
+			}
+			col, op := f[0], f[1]
+			v, err := p.value(f[2])
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "=":
+				alts = append(alts, func(row map[string]driver.Value) bool { return row[col] != nil && str(row[col]) == str(v) })
+			case "<=", ">":
+				alts = append(alts, func(row map[string]driver.Value) bool {
+					if row[col] == nil {
+						return false
+					}
+					a, _ := strconv.ParseInt(str(row[col]), 10, 64)
+					b, _ := strconv.ParseInt(str(v), 10, 64)
+					if op == "<=" {
+						return a <= b
+					}
+					return a > b
+				})
+			default:
+				return nil, fmt.Errorf("fakedb: unsupported operator %q", op)
+			}
+		}
+		prev := match
+		match = func(row map[string]driver.Value) bool {
+			if !prev(row) {
+				return false
+			}
+			for _, alt := range alts {
+				if alt(row) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return match, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    []map[string]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, col := range r.columns {
+		dest[i] = r.rows[0][col]
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func splitList(s string) []string {
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+func sameValues(a, b map[string]driver.Value, columns []string) bool {
+	for _, col := range columns {
+		if a[col] == nil || b[col] == nil || str(a[col]) != str(b[col]) {
+			return false
+		}
+	}
+	return true
+}
+
+func str(v driver.Value) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
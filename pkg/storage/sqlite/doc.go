@@ -0,0 +1,5 @@
+// Package sqlite is a storage backend keeping items in a SQLite database,
+// opened with URIs like sqlite:///var/lib/gearhulk/gearhulk.sqlite.
+//
+// The backend uses the pure Go driver modernc.org/sqlite, no cgo needed.
+package sqlite
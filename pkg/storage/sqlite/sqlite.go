@@ -0,0 +1,159 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"reflect"
+
+	"github.com/drawks/gearhulk/pkg/storage"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `CREATE TABLE IF NOT EXISTS gearhulk_items (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+)`
+
+type SqliteDb struct {
+	db *sql.DB
+}
+
+var _ storage.Db = &SqliteDb{}
+var _ storage.BatchWriter = &SqliteDb{}
+var _ storage.Scanner = &SqliteDb{}
+var _ storage.Compacter = &SqliteDb{}
+
+func init() {
+	storage.Register("sqlite", func(u *url.URL) (storage.Db, error) {
+		return New(storage.Path(u))
+	})
+}
+
+func New(path string) (storage.Db, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	//a single connection serializes writers, SQLite locks the whole file anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqliteDb{db: db}, nil
+}
+
+func (q *SqliteDb) Add(item storage.DbItem) error {
+	buf, err := storage.Encode(item)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec(`INSERT INTO gearhulk_items (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, item.Key(), buf)
+	return err
+}
+
+func (q *SqliteDb) Delete(item storage.DbItem) error {
+	_, err := q.db.Exec(`DELETE FROM gearhulk_items WHERE key = ?`, item.Key())
+	return err
+}
+
+// WriteBatch writes the changes in one transaction, synced to disk if sync
+// is set.
+func (q *SqliteDb) WriteBatch(ops []storage.Op, sync bool) error {
+	ctx := context.Background()
+	//the synchronous pragma is per connection and can't change in a transaction
+	conn, err := q.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	synchronous := "OFF"
+	if sync {
+		synchronous = "FULL"
+	}
+	if _, err := conn.ExecContext(ctx, `PRAGMA synchronous = `+synchronous); err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Delete {
+			_, err = tx.Exec(`DELETE FROM gearhulk_items WHERE key = ?`, op.Key)
+		} else {
+			_, err = tx.Exec(`INSERT INTO gearhulk_items (key, value) VALUES (?, ?)
+				ON CONFLICT(key) DO UPDATE SET value = excluded.value`, op.Key, op.Value)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (q *SqliteDb) Get(t storage.DbItem) error {
+	var data []byte
+	err := q.db.QueryRow(`SELECT value FROM gearhulk_items WHERE key = ?`, t.Key()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return storage.Decode(data, t)
+}
+
+func (q *SqliteDb) GetAll(t storage.DbItem) ([]storage.DbItem, error) {
+	rows, err := q.db.Query(`SELECT value FROM gearhulk_items WHERE substr(key, 1, ?) = ? ORDER BY key`,
+		len(t.Prefix()), t.Prefix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]storage.DbItem, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		obj := reflect.New(reflect.TypeOf(t).Elem()).Interface().(storage.DbItem)
+		if err := storage.Decode(data, obj); err != nil {
+			return nil, err
+		}
+		items = append(items, obj)
+	}
+	return items, rows.Err()
+}
+
+func (q *SqliteDb) Scan(prefix string, fn func(key string, value []byte) error) error {
+	rows, err := q.db.Query(`SELECT key, value FROM gearhulk_items WHERE substr(key, 1, ?) = ? ORDER BY key`,
+		len(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return err
+		}
+		if err := fn(key, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (q *SqliteDb) Compact() error {
+	_, err := q.db.Exec(`VACUUM`)
+	return err
+}
+
+func (q *SqliteDb) Close() error {
+	return q.db.Close()
+}
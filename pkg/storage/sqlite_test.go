@@ -0,0 +1,10 @@
+package storage_test
+
+import (
+	_ "github.com/drawks/gearhulk/pkg/storage/sqlite"
+)
+
+func init() {
+	testBackends["sqlite"] = func(dir string) string { return "sqlite://" + dir + "/gearhulk.sqlite" }
+	persistent["sqlite"] = true
+}
@@ -1,7 +1,20 @@
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by Get when there is no item with the key.
+var ErrNotFound = errors.New("storage: item not found")
+
 type Db interface {
 	ItemQueue
+	Close() error
 }
 
 type DbItem interface {
@@ -15,3 +28,71 @@ type ItemQueue interface {
 	Get(t DbItem) error
 	GetAll(t DbItem) ([]DbItem, error)
 }
+
+// Scanner is implemented by backends which iterate over the stored form of
+// items, for tools that must cope with records which don't decode.
+type Scanner interface {
+	Scan(prefix string, fn func(key string, value []byte) error) error
+}
+
+// Compacter is implemented by backends which can reclaim the space of
+// deleted and overwritten items.
+type Compacter interface {
+	Compact() error
+}
+
+// Opener opens a storage backend for a URI with its scheme.
+type Opener func(u *url.URL) (Db, error)
+
+var (
+	mu       sync.RWMutex
+	backends = make(map[string]Opener)
+)
+
+// Register makes a storage backend available to Open under a URI scheme.
+func Register(scheme string, open Opener) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := backends[scheme]; dup {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	backends[scheme] = open
+}
+
+// Schemes returns the registered URI schemes, sorted.
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the storage backend selected by the scheme of uri, e.g.
+// leveldb:///var/lib/gearhulk or memory://. A plain directory path opens
+// a LevelDB store in it.
+func Open(uri string) (Db, error) {
+	if !strings.Contains(uri, "://") {
+		uri = "leveldb://" + uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	open, ok := backends[u.Scheme]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown backend %q, available: %v", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	return open(u)
+}
+
+// Path returns the file system path of a backend URI. The host of a URI
+// like leveldb://relative/dir is the first element of a relative path.
+func Path(u *url.URL) string {
+	return u.Host + u.Path
+}
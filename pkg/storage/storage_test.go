@@ -1,9 +1,7 @@
 package storage_test
 
 import (
-	"flag"
 	"io/ioutil"
-	"log"
 	"os"
 	"sync"
 	"testing"
@@ -11,57 +9,81 @@ import (
 
 	. "github.com/drawks/gearhulk/pkg/runtime"
 	. "github.com/drawks/gearhulk/pkg/storage"
-	. "github.com/drawks/gearhulk/pkg/storage/leveldb"
+	_ "github.com/drawks/gearhulk/pkg/storage/leveldb"
+	_ "github.com/drawks/gearhulk/pkg/storage/memory"
 	"github.com/stretchr/testify/assert"
 )
 
-var (
-	db ItemQueue
-)
+// testBackends are the storage URIs the conformance tests run against, dir
+// is an empty temp dir. Tagged backends add themselves in their own files.
+var testBackends = map[string]func(dir string) string{
+	"leveldb": func(dir string) string { return "leveldb://" + dir },
+	"memory":  func(dir string) string { return "memory://" },
+}
+
+// persistent lists the backends which keep items across Close.
+var persistent = map[string]bool{"leveldb": true}
 
 var testJobs = []*Job{
 	{Handle: JobPrefix + "handle0_", Id: "id0_",
-		Data: []byte("data0_"), CreateAt: time.Now(), ProcessAt: time.Now(), FuncName: "funcName0_", Priority: 0},
+		Data: []byte("data0_"), CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), FuncName: "funcName0_", Priority: 0},
 	{Handle: JobPrefix + "", Id: "id1_",
-		Data: []byte("data1_"), CreateAt: time.Now().UTC(), ProcessAt: time.Now(), FuncName: "funcName1_", Priority: 1},
+		Data: []byte("data1_"), CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), FuncName: "funcName1_", Priority: 1},
 	{Handle: JobPrefix + "handle2_", Id: "id2_",
 		Data: []byte("data2_"), FuncName: "funcName2_", CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), Priority: 2},
 	{Handle: JobPrefix + "handle3_", Id: "id3_",
 		CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), FuncName: "funcName3_", Priority: 3},
 	{Handle: JobPrefix + "handle4_", Id: "id4_",
-		CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), FuncName: "funcName4_", Priority: 4},
+		CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), FuncName: "funcName4_", Priority: 4,
+		TimeoutSec: 30, DeadlineSec: 30, Deadline: time.Now().UTC().Add(30 * time.Second)},
 	{Handle: JobPrefix + "handle5_", Id: "id5_",
 		Data: []byte("don't store"), FuncName: "funcName5_", CreateAt: time.Now().UTC(), ProcessAt: time.Now().UTC(), Priority: 5},
 }
 
 var testCronJobs = []*CronJob{
 	{JobTemplete: *testJobs[0], Handle: CronJobPrefix + "handle0_", CronEntryID: 1, Expression: "* * 1 * *",
-		Next: time.Now().Add(10), Prev: time.Now().Add(-10), Created: 1},
+		Next: time.Now().UTC().Add(10), Prev: time.Now().UTC().Add(-10), Created: 1},
 	{JobTemplete: *testJobs[0], Handle: CronJobPrefix + "handle1_", CronEntryID: 2, Expression: "* * 2 * *",
-		Next: time.Now().Add(10), Prev: time.Now().Add(-10), Created: 2},
+		Next: time.Now().UTC().Add(10), Prev: time.Now().UTC().Add(-10), Created: 2},
 	{JobTemplete: *testJobs[0], Handle: CronJobPrefix + "handle2_", CronEntryID: 3, Expression: "* * 3 * *",
-		Next: time.Now().Add(10), Prev: time.Now().Add(-10), Created: 3},
+		Next: time.Now().UTC().Add(10), Prev: time.Now().UTC().Add(-10), Created: 3},
 	{JobTemplete: *testJobs[0], Handle: CronJobPrefix + "handle3_", CronEntryID: 4, Expression: "* * 4 * *",
-		Next: time.Now().Add(10), Prev: time.Now().Add(-10), Created: 4},
+		Next: time.Now().UTC().Add(10), Prev: time.Now().UTC().Add(-10), Created: 4},
 	{JobTemplete: *testJobs[0], Handle: CronJobPrefix + "handle4_", CronEntryID: 5, Expression: "* * 5 * *",
-		Next: time.Now().Add(10), Prev: time.Now().Add(-10), Created: 5},
+		Next: time.Now().UTC().Add(10), Prev: time.Now().UTC().Add(-10), Created: 5},
 }
 
-func init() {
-	flag.Parse()
-
-	dir, err := ioutil.TempDir(os.TempDir(), "g2")
+func openTestDb(tb testing.TB, uri string) Db {
+	db, err := Open(uri)
 	if err != nil {
-		log.Fatal(err)
+		tb.Fatal(err)
 	}
-	log.Printf("Using temp dir %v", dir)
-	db, err = New(dir)
-	if err != nil {
-		log.Fatal(err)
+	return db
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, name, dir string)) {
+	for name := range testBackends {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "g2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			test(t, name, dir)
+		})
 	}
 }
 
 func TestAll(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name, dir string) {
+		db := openTestDb(t, testBackends[name](dir))
+		defer db.Close()
+		testAll(t, db)
+	})
+}
+
+func testAll(t *testing.T, db ItemQueue) {
 	//Add test
 	for _, j := range testJobs {
 		testAdd(t, db, j)
@@ -117,7 +139,142 @@ func TestAll(t *testing.T) {
 	assert.Equal(t, len(testCronJobs)-1, len(allCronJobs))
 }
 
+func TestGetNotFound(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name, dir string) {
+		db := openTestDb(t, testBackends[name](dir))
+		defer db.Close()
+		assert.Equal(t, ErrNotFound, db.Get(&Job{Handle: JobPrefix + "missing"}))
+		testAdd(t, db, testJobs[2])
+		testDelete(t, db, testJobs[2])
+		assert.Equal(t, ErrNotFound, db.Get(&Job{Handle: testJobs[2].Handle}))
+		//deleting a missing item is not an error
+		testDelete(t, db, testJobs[2])
+	})
+}
+
+func TestPrefixIsolation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name, dir string) {
+		db := openTestDb(t, testBackends[name](dir))
+		defer db.Close()
+		j := &Job{Handle: JobPrefix + "same"}
+		cj := &CronJob{Handle: CronJobPrefix + "same"}
+		dj := &DeadJob{Job: Job{Handle: JobPrefix + "same"}, Reason: "failed"}
+		for _, item := range []DbItem{j, cj, dj} {
+			testAdd(t, db, item)
+		}
+		for _, itemType := range []DbItem{&Job{}, &CronJob{}, &DeadJob{}} {
+			assert.Len(t, testGetAll(t, db, itemType), 1)
+		}
+		testDelete(t, db, dj)
+		assert.Len(t, testGetAll(t, db, &DeadJob{}), 0)
+		assert.Len(t, testGetAll(t, db, &Job{}), 1)
+	})
+}
+
+func TestGetAllOrder(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name, dir string) {
+		db := openTestDb(t, testBackends[name](dir))
+		defer db.Close()
+		for _, h := range []string{"c", "a", "b"} {
+			testAdd(t, db, &Job{Handle: JobPrefix + h})
+		}
+		items := testGetAll(t, db, &Job{})
+		handles := make([]string, 0, len(items))
+		for _, item := range items {
+			handles = append(handles, item.(*Job).Handle)
+		}
+		assert.Equal(t, []string{JobPrefix + "a", JobPrefix + "b", JobPrefix + "c"}, handles)
+	})
+}
+
+func TestReopen(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name, dir string) {
+		if !persistent[name] {
+			t.Skip("backend does not persist items")
+		}
+		uri := testBackends[name](dir)
+		db := openTestDb(t, uri)
+		testAdd(t, db, testJobs[0])
+		testAdd(t, db, testCronJobs[0])
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db = openTestDb(t, uri)
+		defer db.Close()
+		j := &Job{Handle: testJobs[0].Handle}
+		testGet(t, db, j)
+		assert.Equal(t, testJobs[0], j)
+		assert.Len(t, testGetAll(t, db, &CronJob{}), 1)
+	})
+}
+
+func TestWriteBatch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name, dir string) {
+		uri := testBackends[name](dir)
+		db := openTestDb(t, uri)
+		w, ok := db.(BatchWriter)
+		if !ok {
+			db.Close()
+			t.Skip("backend writes changes one by one")
+		}
+		op := func(item DbItem, del bool) Op {
+			buf, err := Encode(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return Op{Key: item.Key(), Value: buf, Delete: del}
+		}
+		assert.NoError(t, w.WriteBatch([]Op{op(testJobs[0], false), op(testJobs[1], false)}, false))
+		assert.NoError(t, w.WriteBatch([]Op{op(testJobs[1], true), op(testCronJobs[0], false)}, true))
+		if persistent[name] {
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db = openTestDb(t, uri)
+		}
+		defer db.Close()
+		assert.Equal(t, []DbItem{testJobs[0]}, testGetAll(t, db, &Job{}))
+		assert.Len(t, testGetAll(t, db, &CronJob{}), 1)
+	})
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "g2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//a plain path is a LevelDB directory
+	db := openTestDb(t, dir)
+	testAdd(t, db, testJobs[0])
+	db.Close()
+	db = openTestDb(t, "leveldb://"+dir)
+	testGet(t, db, &Job{Handle: testJobs[0].Handle})
+	db.Close()
+
+	_, err = Open("nosuch://")
+	assert.Error(t, err)
+	assert.Contains(t, Schemes(), "memory")
+}
+
 func BenchmarkBasicOpts(b *testing.B) {
+	for name := range testBackends {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "g2")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			db := openTestDb(b, testBackends[name](dir))
+			defer db.Close()
+			benchmarkBasicOpts(b, db)
+		})
+	}
+}
+
+func benchmarkBasicOpts(b *testing.B, db ItemQueue) {
 	b.StopTimer()
 	n := b.N
 	wg := sync.WaitGroup{}
@@ -3,6 +3,7 @@ package worker
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"net"
@@ -19,6 +20,7 @@ type agent struct {
 	worker    *Worker
 	in        chan []byte
 	net, addr string
+	tlsConfig *tls.Config //nil for plain TCP
 }
 
 // Create the agent of job server.
@@ -35,7 +37,7 @@ func newAgent(net, addr string, worker *Worker) (a *agent, err error) {
 func (a *agent) Connect() (err error) {
 	a.Lock()
 	defer a.Unlock()
-	a.conn, err = net.Dial(a.net, a.addr)
+	a.conn, err = a.dial()
 	if err != nil {
 		return
 	}
@@ -45,6 +47,14 @@ func (a *agent) Connect() (err error) {
 	return
 }
 
+// dial connects to the job server, with TLS if configured.
+func (a *agent) dial() (net.Conn, error) {
+	if a.tlsConfig != nil {
+		return tls.Dial(a.net, a.addr, a.tlsConfig)
+	}
+	return net.Dial(a.net, a.addr)
+}
+
 func (a *agent) work() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -78,7 +88,7 @@ func (a *agent) work() {
 				// closed by Gearmand, the agent should close the conection
 				// and reconnect to job server.
 				a.Close()
-				a.conn, err = net.Dial(a.net, a.addr)
+				a.conn, err = a.dial()
 				if err != nil {
 					a.worker.err(err)
 					break
@@ -115,7 +125,10 @@ func (a *agent) work() {
 }
 
 func (a *agent) disconnect_error(err error) {
-	if a.conn != nil {
+	a.Lock()
+	connected := a.conn != nil
+	a.Unlock()
+	if connected {
 		err = &WorkerDisconnectError{
 			err:   err,
 			agent: a,
@@ -142,6 +155,9 @@ func (a *agent) Grab() {
 func (a *agent) grab() {
 	outpack := getOutPack()
 	outpack.dataType = rt.PT_GrabJobUniq
+	if a.worker.GrabAll {
+		outpack.dataType = rt.PT_GrabJobAll
+	}
 	a.write(outpack)
 }
 
@@ -156,7 +172,7 @@ func (a *agent) PreSleep() {
 func (a *agent) reconnect() error {
 	a.Lock()
 	defer a.Unlock()
-	conn, err := net.Dial(a.net, a.addr)
+	conn, err := a.dial()
 	if err != nil {
 		return err
 	}
@@ -183,6 +199,9 @@ func (a *agent) read() (data []byte, err error) {
 		return
 	}
 	dl := int(binary.BigEndian.Uint32(tmp[8:12]))
+	if dl > a.worker.maxPacketSize() {
+		return nil, ErrPacketTooLarge
+	}
 
 	// write what we read so far
 	buf.Write(tmp[:n])
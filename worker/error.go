@@ -11,6 +11,8 @@ var (
 	ErrNoneFuncs  = errors.New("None functions")
 	ErrTimeOut    = errors.New("Executing time out")
 	ErrUnknown    = errors.New("Unknown error")
+
+	ErrPacketTooLarge = errors.New("Packet too large")
 )
 
 // Extract the error message
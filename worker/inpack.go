@@ -14,9 +14,12 @@ type inPack struct {
 	dataType             rt.PT
 	data                 []byte
 	handle, uniqueId, fn string
+	reducer              string
 	a                    *agent
 }
 
+var _ ReduceJob = &inPack{}
+
 // Create a new job
 func getInPack() *inPack {
 	return &inPack{}
@@ -38,6 +41,10 @@ func (inpack *inPack) UniqueId() string {
 	return inpack.uniqueId
 }
 
+func (inpack *inPack) Reducer() string {
+	return inpack.reducer
+}
+
 func (inpack *inPack) Err() error {
 	if inpack.dataType == rt.PT_Error {
 		return getError(inpack.data)
@@ -123,6 +130,15 @@ func decodeInPack(data []byte) (inpack *inPack, l int, err error) {
 			inpack.uniqueId = string(s[2])
 			inpack.data = s[3]
 		}
+	case rt.PT_JobAssignAll:
+		s := bytes.SplitN(dt, []byte{'\x00'}, 5)
+		if len(s) == 5 {
+			inpack.handle = string(s[0])
+			inpack.fn = string(s[1])
+			inpack.uniqueId = string(s[2])
+			inpack.reducer = string(s[3])
+			inpack.data = s[4]
+		}
 	default:
 		inpack.data = dt
 	}
@@ -28,6 +28,14 @@ var (
 			"uid":    "c",
 			"data":   "xyz",
 		},
+		rt.PT_JobAssignAll: {
+			"src":     "\x00RES\x00\x00\x00\x28\x00\x00\x00\x0ba\x00b\x00c\x00d\x00xyz",
+			"handle":  "a",
+			"fn":      "b",
+			"uid":     "c",
+			"reducer": "d",
+			"data":    "xyz",
+		},
 	}
 )
 
@@ -55,6 +63,11 @@ func TestInPack(t *testing.T) {
 				t.Errorf("UID: %s expected, %s got.", uid, inpack.uniqueId)
 			}
 		}
+		if reducer, ok := v["reducer"]; ok {
+			if inpack.reducer != reducer {
+				t.Errorf("Reducer: %s expected, %s got.", reducer, inpack.reducer)
+			}
+		}
 		if data, ok := v["data"]; ok {
 			if bytes.Compare([]byte(data), inpack.data) != 0 {
 				t.Errorf("UID: %v expected, %v got.", data, inpack.data)
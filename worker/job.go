@@ -12,3 +12,14 @@ type Job interface {
 	Handle() string                                // Returns the job handle
 	UniqueId() string                              // Returns the unique job identifier
 }
+
+// ReduceJob is implemented by the jobs a Worker runs, apart from Job so
+// other implementations of Job keep working. The reducer a job was
+// submitted with is only known when the worker grabs with GrabAll:
+//
+//	if rj, ok := job.(worker.ReduceJob); ok {
+//		reducer := rj.Reducer()
+//	}
+type ReduceJob interface {
+	Reducer() string // Returns the reducer, empty for jobs without one
+}
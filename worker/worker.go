@@ -3,6 +3,7 @@
 package worker
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"sync"
@@ -36,7 +37,14 @@ type Worker struct {
 	Id           string
 	ErrorHandler ErrorHandler
 	JobHandler   JobHandler
-	limit        chan bool
+	// GrabAll makes the worker grab jobs with GRAB_JOB_ALL, so jobs
+	// submitted with a reducer carry its name, see ReduceJob. Set it before
+	// Work.
+	GrabAll bool
+	// MaxPacketSize limits the packet data accepted from a server, a larger
+	// packet drops the connection. rt.DefaultMaxPacketSize when 0.
+	MaxPacketSize int
+	limit         chan bool
 }
 
 // New creates a new Worker instance.
@@ -60,6 +68,13 @@ func New(limit int) (worker *Worker) {
 	return
 }
 
+func (worker *Worker) maxPacketSize() int {
+	if worker.MaxPacketSize > 0 {
+		return worker.MaxPacketSize
+	}
+	return rt.DefaultMaxPacketSize
+}
+
 // inner error handling
 func (worker *Worker) err(e error) {
 	if worker.ErrorHandler != nil {
@@ -72,18 +87,32 @@ func (worker *Worker) err(e error) {
 // Parameters:
 //   - net: Network type (typically "tcp")
 //   - addr: Server address formatted as 'host:port'
+//   - opts: Options of the connection, e.g. WithTLS
 //
 // Returns an error if the connection fails.
-func (worker *Worker) AddServer(net, addr string) (err error) {
+func (worker *Worker) AddServer(net, addr string, opts ...ServerOption) (err error) {
 	// Create a new job server's client as a agent of server
 	a, err := newAgent(net, addr, worker)
 	if err != nil {
 		return err
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
 	worker.agents = append(worker.agents, a)
 	return
 }
 
+// ServerOption configures the connection to a job server added with AddServer.
+type ServerOption func(*agent)
+
+// WithTLS connects to the job server over TLS with the given configuration.
+func WithTLS(config *tls.Config) ServerOption {
+	return func(a *agent) {
+		a.tlsConfig = config
+	}
+}
+
 // Broadcast an outpack to all Gearman server.
 func (worker *Worker) broadcast(outpack *outPack) {
 	for _, v := range worker.agents {
@@ -166,7 +195,7 @@ func (worker *Worker) handleInPack(inpack *inPack) {
 		if !worker.isShuttingDown() {
 			inpack.a.Grab()
 		}
-	case rt.PT_JobAssign, rt.PT_JobAssignUniq:
+	case rt.PT_JobAssign, rt.PT_JobAssignUniq, rt.PT_JobAssignAll:
 		go func() {
 			if err := worker.exec(inpack); err != nil {
 				worker.err(err)